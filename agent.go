@@ -27,44 +27,123 @@ SOFTWARE.
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/jimfenton/notif-agent/notif"
 	_ "github.com/lib/pq"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// Time allowed for in-flight requests and deliveries to finish on
+// shutdown, unless set in agent.cfg
+const defaultShutdownTimeout = 30 * time.Second
+
 type AgentDbCfg struct {
 	Host     string `json:"host"`
 	User     string `json:"user"`
 	Dbname   string `json:"dbname"`
 	Password string `json:"password"`
+
+	// Reject signed requests that lack a nonce (jti) and timestamp (iat)
+	// rather than accepting them from legacy notifiers
+	RequireNonce bool `json:"require_nonce"`
+
+	// What to do when a notifier signs with a key other than the one
+	// pinned for its authorization: "refuse" (default) or "alert"
+	KeyChange string `json:"key_change"`
+
+	// Directory of notifier keys not published in DNS, as
+	// <key_dir>/<domain>/<selector>.pem or .jwk
+	KeyDir string `json:"key_dir"`
+
+	// If set, serve runtime counters (/debug/vars) on this address,
+	// e.g. "localhost:5343"
+	DebugAddr string `json:"debug_addr"`
+
+	// Size limits in bytes for the request body and the notif's subject
+	// and body; zero selects the default
+	MaxBody      int `json:"max_body"`
+	MaxSubject   int `json:"max_subject"`
+	MaxNotifBody int `json:"max_notif_body"`
+
+	// Native API server timeouts in seconds; zero selects the default
+	ReadHeaderTimeout int `json:"read_header_timeout"`
+	ReadTimeout       int `json:"read_timeout"`
+	WriteTimeout      int `json:"write_timeout"`
+	IdleTimeout       int `json:"idle_timeout"`
+
+	// Seconds allowed to finish in-flight work on SIGTERM or SIGINT;
+	// zero selects the default
+	ShutdownTimeout int `json:"shutdown_timeout"`
+
+	// Domain shown as the sender of the agent's own summary notifs;
+	// defaults to the host name
+	Domain string `json:"domain"`
 }
 
 // Find an user record by ID
 func findUser(db *sql.DB, userID int, user *notif.Userinfo) error {
+	var emailFrom sql.NullString
+	var emailPassword sql.NullString
 	var twilioSID sql.NullString
 	var twilioToken sql.NullString
 	var twilioFrom sql.NullString
+	var timeZone sql.NullString
+	var digestSchedule sql.NullString
 
-	err := db.QueryRow(`SELECT id,email_username,email_server,email_port,email_authentication,email_security,twilio_sid,twilio_token,twilio_from,count,latest,created,user_id FROM userext WHERE user_id = $1`, userID).Scan(&user.Id,
+	err := db.QueryRow(`SELECT id,email_username,email_server,email_port,email_authentication,email_security,email_from,email_password,twilio_sid,twilio_token,twilio_from,time_zone,quiet_priority,digest_schedule,digest_hour,count,latest,created,user_id FROM userext WHERE user_id = $1`, userID).Scan(&user.Id,
 		&user.EmailUsername,
 		&user.EmailServer,
 		&user.EmailPort,
 		&user.EmailAuthentication,
 		&user.EmailSecurity,
+		&emailFrom,
+		&emailPassword,
 		&twilioSID,
 		&twilioToken,
 		&twilioFrom,
+		&timeZone,
+		&user.QuietPriority,
+		&digestSchedule,
+		&user.DigestHour,
 		&user.Count,
 		&user.Latest,
 		&user.Created,
 		&user.UserID)
+	user.EmailFrom = emailFrom.String
+	user.EmailPassword = emailPassword.String
 	user.TwilioSID = twilioSID.String
 	user.TwilioToken = twilioToken.String
 	user.TwilioFrom = twilioFrom.String
+	user.TimeZone = timeZone.String
+	user.DigestSchedule = digestSchedule.String
+	if err != nil {
+		return err
+	}
+	user.Quiet, err = findQuiet(db, userID)
+	return err
+}
+
+// Operations common to *sql.DB and *sql.Tx
+type dbHandle interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Store a new notif. Common to all collectors.
+func insertNotif(db dbHandle, nd notif.Notif) error {
+	idemkey := sql.NullString{String: nd.IdemKey, Valid: nd.IdemKey != ""}
+
+	_, err := db.Exec(`INSERT INTO notification (user_id,toaddr,description,origtime,priority,fromdomain,expires,subject,body,notid,recvtime,revcount,read,readtime,source,deleted,idempotency_key) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17)`,
+		nd.UserID, nd.To, nd.Description, nd.Origtime, nd.Priority, nd.From, nd.Expires, nd.Subject, nd.Body, nd.NotID, nd.RecvTime, nd.RevCount, nd.Read, nil, nd.Source, nd.Deleted, idemkey)
 	return err
 }
 
@@ -84,7 +163,6 @@ func findSite(db *sql.DB, site *notif.Siteinfo) error {
 
 func main() {
 
-	var user notif.Userinfo
 	var site notif.Siteinfo
 	var adc AgentDbCfg
 
@@ -112,19 +190,133 @@ func main() {
 		fmt.Println("Can't retrieve site configuration info:", err) // non-fatal for now at least
 	}
 
+	if adc.DebugAddr != "" {
+		go func() {
+			fmt.Println("Debug listener error:", http.ListenAndServe(adc.DebugAddr, nil))
+		}()
+	}
+
+	if adc.Domain != "" {
+		agentDomain = adc.Domain
+	} else if host, err := os.Hostname(); err == nil {
+		agentDomain = host
+	}
+
+	// Persistent queue of pending pushes
+	queue := newDeliveryQueue(db, site)
+	go queue.run()
+
+	reaper := runEvery(reapInterval, func() { reapExpired(db) })
+	releaser := runEvery(releaseInterval, func() { releaseHeld(db, queue) })
+	digester := runEvery(digestInterval, func() { sendDigests(db, queue) })
+
+	// Escalation of urgent notifs that haven't been read
+	esc := newEscalator(db, queue)
+	go esc.run()
+
 	// Channel for notif collectors
 	cc := make(chan notif.Notif, 10)
 
-	go collectNative(db, cc) //Listen for native notifs
+	dispatch := func(n notif.Notif) { processNotif(db, queue, esc, n) }
+	srv := newNativeServer(db, cc, dispatch, adc) //Listen for native notifs
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			fmt.Println("Native listener error:", err)
+			os.Exit(1)
+		}
+	}()
 
-	for notif := range cc {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
 
-		err := findUser(db, notif.UserID, &user)
+collect:
+	for {
+		select {
+		case notif := <-cc:
+			processNotif(db, queue, esc, notif)
+		case sig := <-sigs:
+			fmt.Println("Shutting down on", sig)
+			break collect
+		}
+	}
+
+	timeout := defaultShutdownTimeout
+	if adc.ShutdownTimeout > 0 {
+		timeout = time.Duration(adc.ShutdownTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop accepting requests and wait for the ones in progress, which
+	// may still be sending on cc, so keep draining it meanwhile
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown(ctx)
+	}()
+	for stopped := false; !stopped; {
+		select {
+		case notif := <-cc:
+			processNotif(db, queue, esc, notif)
+		case err := <-done:
+			if err != nil {
+				fmt.Println("Native listener shutdown error:", err)
+			}
+			stopped = true
+		}
+	}
+
+	// Whatever is left in the channel
+	for drained := false; !drained; {
+		select {
+		case notif := <-cc:
+			processNotif(db, queue, esc, notif)
+		default:
+			drained = true
+		}
+	}
+
+	// Stop the background tasks before the delivery queue, since most
+	// of them add deliveries
+	for _, w := range []*worker{reaper, releaser, digester, esc.worker} {
+		err = w.stop(ctx)
+		if err != nil {
+			fmt.Println("Background task shutdown error:", err)
+		}
+	}
+
+	err = queue.stop(ctx)
+	if err != nil {
+		fmt.Println("Delivery queue shutdown error:", err)
+	}
+	fmt.Println("Shutdown complete")
+}
+
+// Run a collected notif through the user's rules
+func processNotif(db *sql.DB, queue *deliveryQueue, esc *escalator, n notif.Notif) {
+	var user notif.Userinfo
+
+	if n.Deleted { //Retracted; don't push anything still queued
+		err := queue.cancel(n.NotID)
 		if err != nil {
-			fmt.Println("Can't retrieve user info for push:", err) // non-fatal
-		} else {
-			ProcessRules(notif, db, user, site)
+			fmt.Println("Can't cancel deliveries for deleted notif:", err)
 		}
+		err = esc.cancel(n.NotID)
+		if err != nil {
+			fmt.Println("Can't stop escalation for deleted notif:", err)
+		}
+		return
+	}
+
+	if n.Expired(time.Now()) {
+		fmt.Println("Not pushing expired notif ", n.NotID)
+		return
 	}
 
+	err := findUser(db, n.UserID, &user)
+	if err != nil {
+		fmt.Println("Can't retrieve user info for push:", err) // non-fatal
+	} else {
+		ProcessRules(n, db, user, queue, esc)
+	}
 }
@@ -28,155 +28,163 @@ package main
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/jimfenton/notif-agent/notif"
-	"io"
-	"net"
-	"net/http"
-	"strings"
+	"math/big"
 )
 
-//Check the signature
+//Check the signature. Returns nil if the request is properly signed.
 func checkSig(
 	npr notifProtected,
-	w http.ResponseWriter,
 	auth notif.Auth,
-	flatload []string) bool { //TODO: args a bit redundant (npr, flatload). Rationalize.
+	flatload []string,
+	keys KeySource,
+	pins *keyPins) *apiError { //TODO: args a bit redundant (npr, flatload). Rationalize.
 
-	var publickey *rsa.PublicKey
-	var h crypto.Hash
-	var err error
-	var pubkey []byte
-
-	if npr.Algorithm != "RS256" {
-
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Unsupported signature algorithm")
-		return true
+	if npr.Algorithm != "RS256" && npr.Algorithm != "ES256" && npr.Algorithm != "EdDSA" {
+		return &apiError{CodeUnsupportedAlg, "Unsupported signature algorithm"}
 	}
 
-	//Retrieve the public key for the signature. This is a DKIM key found in DNS at
-	// <kid>._domainkey.<domain>, as the value of the p= tag.
+	//Retrieve the public key for the signature. Normally this is a DKIM key found
+	// in DNS at <kid>._domainkey.<domain>, as the value of the p= tag.
 
-	pubkey64 := getkey(npr.Selector, auth.Domain)
-
-	//Parse the public key
-	pubkey, err = base64.StdEncoding.DecodeString(pubkey64)
+	pub, err := keys.Key(npr.Selector, auth)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Public key decode error")
-		return true
+		fmt.Println("Signature key error: ", err)
+		if isTemporary(err) {
+			return &apiError{CodeKeyLookupFailed, "Public key lookup failed"}
+		}
+		if errors.Is(err, errKeyRevoked) {
+			return &apiError{CodeKeyRevoked, "Public key revoked"}
+		}
+		return &apiError{CodeKeyNotFound, "Public key not found"}
 	}
 
-	pub, err := x509.ParsePKIXPublicKey(pubkey)
+	sig, err := base64.URLEncoding.DecodeString(pad64(flatload[2]))
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Public key parse error")
-		return true
+		return &apiError{CodeBadSignature, "Signature decode error"}
 	}
 
-	publickey, ok := pub.(*rsa.PublicKey)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Value not a public key")
-		return true
-	}
-
-	sig, err := base64.URLEncoding.DecodeString(pad64(flatload[2]))
+	err = verifySig(npr.Algorithm, pub, []byte(flatload[0]+"."+flatload[1]), sig)
 	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, "Signature decode error")
-		return true
+		return &apiError{CodeSignatureInvalid, "Signature verification error"}
 	}
 
-	h = crypto.SHA256
-	hash := sha256.New()
-	io.WriteString(hash, flatload[0]+"."+flatload[1])
-	hashstr := hash.Sum(nil)
-
-	err = rsa.VerifyPKCS1v15(publickey, h, hashstr, sig)
-	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprint(w, "Signature verification error")
-		return true
+	//Make sure the key is the one we expect this notifier to use
+	if pins != nil {
+		ok, err := pins.check(auth, npr.Selector, pub)
+		if err != nil {
+			fmt.Println("Key pin error: ", err)
+			return &apiError{CodeInternal, "Key pin check failed"}
+		}
+		if !ok {
+			return &apiError{CodeKeyChanged, "Signing key changed"}
+		}
 	}
 
-	return false
+	return nil
 }
 
-//Find the next tag/value in a DKIM key record
-// return values:
-// tag (string) - name of the tag found
-// value (string) - value associated with tag
-// next (int) - index to next tag/value if any, or 0 if last one
-
-func nexttag(keyrec string, start int) (string, string, int) {
-	var tag string
-	var value string
-
-	eq := strings.Index(keyrec[start:], "=")
-	if eq == -1 {
-		return "", "", -1
+// Decode the p= value of a DKIM key record according to its k= type.
+// RSA keys (and, as an extension, P-256 "ec" keys) are SubjectPublicKeyInfo
+// structures; Ed25519 keys are the bare 32-byte public key (RFC 8463).
+func parsePublicKey(keytype string, pubkey []byte) (crypto.PublicKey, error) {
+	switch keytype {
+	case "rsa", "ec":
+		pub, err := x509.ParsePKIXPublicKey(pubkey)
+		if err != nil {
+			return nil, err
+		}
+		switch pub.(type) {
+		case *rsa.PublicKey:
+			if keytype != "rsa" {
+				return nil, errors.New("RSA key in non-RSA key record")
+			}
+		case *ecdsa.PublicKey:
+			if keytype != "ec" {
+				return nil, errors.New("EC key in non-EC key record")
+			}
+		default:
+			return nil, errors.New("unsupported public key type")
+		}
+		return pub, nil
+	case "ed25519":
+		if len(pubkey) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 public key length")
+		}
+		return ed25519.PublicKey(pubkey), nil
 	}
-	tag = strings.TrimSpace(keyrec[start : eq+start])
-	sc := strings.Index(keyrec[start:], ";")
+	return nil, errors.New("unsupported key type " + keytype)
+}
 
-	if sc == -1 { //Last field
-		value = strings.TrimSpace(keyrec[eq+start+1:])
-		return tag, value, -1
-	}
+// The k= type and base64 p= value for a public key, the inverse of
+// parsePublicKey
+func encodePublicKey(pub crypto.PublicKey) (string, string, error) {
+	var keytype string
+	var pubkey []byte
 
-	if eq > sc { //no equals sign between semicolons so empty answer
-		return "", "", sc + start + 1
+	switch pk := pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pk)
+		if err != nil {
+			return "", "", err
+		}
+		keytype, pubkey = "ec", der
+		if _, ok := pk.(*rsa.PublicKey); ok {
+			keytype = "rsa"
+		}
+	case ed25519.PublicKey:
+		keytype, pubkey = "ed25519", pk
+	default:
+		return "", "", errors.New("unsupported public key type")
 	}
-	value = strings.TrimSpace(keyrec[eq+start+1 : sc+start])
-
-	return tag, value, sc + start + 1
+	return keytype, base64.StdEncoding.EncodeToString(pubkey), nil
 }
 
-// Retrieve and verify a DKIM public key from DNS.
-func getkey(selector string, domain string) string {
-
-	var pubkey string
-	var tag string
-	var value string
-
-	selectors, err := net.LookupTXT(selector + "._domainkey." + domain)
-	if err != nil {
-		fmt.Println("Signature key not found: ", err)
-		return ""
-	}
+// Verify a JWS signature over input with the given algorithm
+func verifySig(alg string, pub crypto.PublicKey, input []byte, sig []byte) error {
+	switch alg {
+	case "RS256":
+		publickey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 requires an RSA key")
+		}
+		hash := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(publickey, crypto.SHA256, hash[:], sig)
 
-	//Just looking at the first TXT record. Multiple TXT records are not a good idea.
-	for i := 0; i >= 0; {
-		tag, value, i = nexttag(selectors[0], i)
+	case "ES256":
+		publickey, ok := pub.(*ecdsa.PublicKey)
+		if !ok || publickey.Curve != elliptic.P256() {
+			return errors.New("ES256 requires a P-256 key")
+		}
+		if len(sig) != 64 { //JWS uses the fixed-length R || S form
+			return errors.New("bad ES256 signature length")
+		}
+		hash := sha256.Sum256(input)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(publickey, hash[:], r, s) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
 
-		switch tag {
-		case "v": //Check version if present
-			if value != "DKIM1" {
-				return ""
-			}
-		case "p": //extract key
-			pubkey = value
-		case "k": //Check key type
-			if value != "rsa" {
-				return ""
-			}
-		case "h": //Check allowed hashes
-			// Should handle a list here
-			if value != "sha256" {
-				return ""
-			}
-		case "s": //service type
-			// Should potentially handle a service list here
-			if value != "*" && value != "notif" {
-				return ""
-			}
+	case "EdDSA":
+		publickey, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("EdDSA requires an Ed25519 key")
+		}
+		if !ed25519.Verify(publickey, input, sig) {
+			return errors.New("ed25519: verification error")
 		}
+		return nil
 	}
-	return pubkey
+	return errors.New("unsupported signature algorithm " + alg)
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/jimfenton/notif-agent/notif"
+	"strings"
+	"testing"
+)
+
+// Signing keys of each kind checkSig accepts, and some it doesn't
+type sigKeys struct {
+	rsa  *rsa.PrivateKey
+	p256 *ecdsa.PrivateKey
+	p384 *ecdsa.PrivateKey
+	ed   ed25519.PrivateKey
+}
+
+func newSigKeys(t *testing.T) sigKeys {
+	var k sigKeys
+	var err error
+
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if k.p384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, k.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// JWS signature over input: PKCS #1 v1.5 for RSA, R || S for ECDSA
+func jwsSign(t *testing.T, key crypto.Signer, input string) []byte {
+	hash := sha256.Sum256([]byte(input))
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, []byte(input))
+	}
+	t.Fatalf("unsupported key %T", key)
+	return nil
+}
+
+func TestVerifySig(t *testing.T) {
+	k := newSigKeys(t)
+	const input = "header.payload"
+	esSig := jwsSign(t, k.p256, input)
+
+	// The same signature in the ASN.1 form used outside JWS
+	hash := sha256.Sum256([]byte(input))
+	derSig, err := ecdsa.SignASN1(rand.Reader, k.p256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := append(append([]byte{}, esSig[32:]...), esSig[:32]...)
+
+	tests := []struct {
+		name string
+		alg  string
+		pub  crypto.PublicKey
+		sig  []byte
+		ok   bool
+	}{
+		{"RS256", "RS256", &k.rsa.PublicKey, jwsSign(t, k.rsa, input), true},
+		{"RS256 other input", "RS256", &k.rsa.PublicKey, jwsSign(t, k.rsa, input+"x"), false},
+		{"RS256 EC key", "RS256", &k.p256.PublicKey, jwsSign(t, k.rsa, input), false},
+		{"ES256", "ES256", &k.p256.PublicKey, esSig, true},
+		{"ES256 R and S swapped", "ES256", &k.p256.PublicKey, swapped, false},
+		{"ES256 ASN.1 signature", "ES256", &k.p256.PublicKey, derSig, false},
+		{"ES256 short", "ES256", &k.p256.PublicKey, esSig[:63], false},
+		{"ES256 long", "ES256", &k.p256.PublicKey, append(append([]byte{}, esSig...), 0), false},
+		{"ES256 P-384 key", "ES256", &k.p384.PublicKey, jwsSign(t, k.p384, input), false},
+		{"ES256 RSA key", "ES256", &k.rsa.PublicKey, esSig, false},
+		{"EdDSA", "EdDSA", k.ed.Public(), jwsSign(t, k.ed, input), true},
+		{"EdDSA EC key", "EdDSA", &k.p256.PublicKey, jwsSign(t, k.ed, input), false},
+		{"HS256", "HS256", &k.rsa.PublicKey, jwsSign(t, k.rsa, input), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySig(tt.alg, tt.pub, []byte(input), tt.sig)
+			if (err == nil) != tt.ok {
+				t.Errorf("verifySig: %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParsePublicKeyType(t *testing.T) {
+	k := newSigKeys(t)
+	der := func(pub crypto.PublicKey) []byte {
+		b, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	edPub := k.ed.Public().(ed25519.PublicKey)
+
+	tests := []struct {
+		name    string
+		keytype string
+		pubkey  []byte
+		ok      bool
+	}{
+		{"rsa", "rsa", der(&k.rsa.PublicKey), true},
+		{"ec", "ec", der(&k.p256.PublicKey), true},
+		{"ed25519", "ed25519", edPub, true},
+		{"RSA key as ec", "ec", der(&k.rsa.PublicKey), false},
+		{"EC key as rsa", "rsa", der(&k.p256.PublicKey), false},
+		{"Ed25519 SPKI as rsa", "rsa", der(edPub), false},
+		{"short ed25519", "ed25519", edPub[:31], false},
+		{"SPKI as ed25519", "ed25519", der(edPub), false},
+		{"garbage", "rsa", []byte("not a key"), false},
+		{"unknown type", "dsa", der(&k.rsa.PublicKey), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePublicKey(tt.keytype, tt.pubkey)
+			if (err == nil) != tt.ok {
+				t.Errorf("parsePublicKey: %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// Whole requests signed with each algorithm, as checkSig sees them
+func TestCheckSigAlgorithms(t *testing.T) {
+	k := newSigKeys(t)
+	enc := base64.RawURLEncoding
+
+	tests := []struct {
+		alg  string
+		key  crypto.Signer
+		pub  crypto.PublicKey
+		code string
+	}{
+		{"RS256", k.rsa, &k.rsa.PublicKey, ""},
+		{"ES256", k.p256, &k.p256.PublicKey, ""},
+		{"EdDSA", k.ed, k.ed.Public(), ""},
+		{"ES256", k.p256, &k.rsa.PublicKey, CodeSignatureInvalid},
+		{"RS256", k.rsa, &k.p256.PublicKey, CodeSignatureInvalid},
+		{"ES384", k.p384, &k.p384.PublicKey, CodeUnsupportedAlg},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			npr := notifProtected{Algorithm: tt.alg, Selector: "test"}
+			prot, err := json.Marshal(npr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			input := enc.EncodeToString(prot) + "." + enc.EncodeToString([]byte(`{"subject":"x"}`))
+			flatload := strings.SplitN(input+"."+enc.EncodeToString(jwsSign(t, tt.key, input)), ".", 3)
+
+			aerr := checkSig(npr, notif.Auth{Domain: "example.com"}, flatload, testKeys{pub: tt.pub}, nil)
+			switch {
+			case tt.code == "" && aerr != nil:
+				t.Errorf("refused: %s", aerr.Code)
+			case tt.code != "" && (aerr == nil || aerr.Code != tt.code):
+				t.Errorf("got %v, want %s", aerr, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+/*
+
+deliver.go - Delivery channels for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+)
+
+/* Each Method.Mode is handled by a Deliverer, registered (normally from
+an init function in the file implementing it) with registerDeliverer.
+New channels can be added this way without changing ProcessRules. */
+
+// Outcome of a delivery attempt
+type DeliveryStatus int
+
+const (
+	DeliverySent             DeliveryStatus = iota // Accepted by the channel
+	DeliveryPermanentFailure                       // Will never succeed as configured
+	DeliveryRetryableFailure                       // May succeed if tried again later
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case DeliverySent:
+		return "sent"
+	case DeliveryPermanentFailure:
+		return "permanent failure"
+	case DeliveryRetryableFailure:
+		return "retryable failure"
+	}
+	return "unknown"
+}
+
+type DeliveryResult struct {
+	Status DeliveryStatus
+	Err    error // Reason for failure, nil if sent
+}
+
+func (r DeliveryResult) String() string {
+	if r.Err == nil {
+		return r.Status.String()
+	}
+	return r.Status.String() + ": " + r.Err.Error()
+}
+
+func deliverySent() DeliveryResult {
+	return DeliveryResult{Status: DeliverySent}
+}
+
+func permanentFailure(err error) DeliveryResult {
+	return DeliveryResult{Status: DeliveryPermanentFailure, Err: err}
+}
+
+func retryableFailure(err error) DeliveryResult {
+	return DeliveryResult{Status: DeliveryRetryableFailure, Err: err}
+}
+
+// A Deliverer pushes a notif to the user through one kind of Method
+type Deliverer interface {
+	Deliver(m Method, n notif.Notif, user notif.Userinfo, site notif.Siteinfo) DeliveryResult
+}
+
+var deliverers = make(map[int]Deliverer)
+
+// Register the Deliverer for a Method.Mode. Not safe for use once the
+// agent is running; call it from init.
+func registerDeliverer(mode int, d Deliverer) {
+	if _, dup := deliverers[mode]; dup {
+		panic(fmt.Sprintf("deliverer for mode %d registered twice", mode))
+	}
+	deliverers[mode] = d
+}
@@ -0,0 +1,174 @@
+/*
+
+digest.go - Digest delivery for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* A digest method collects the Routine and Informational notifs sent to
+it rather than pushing them, and a summary of them goes out by its
+target method (usually email or text) on the user's digest schedule:
+every hour, or once a day at the user's digest_hour. Emergency and
+Priority notifs sent to a digest method are pushed by the target method
+right away. Collected notifs are delivery jobs in the digest state. */
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"time"
+)
+
+const digestInterval = time.Minute // Interval between checks for due digests
+
+// A digest method without a usable target
+var errNoDigestTarget = errors.New("digest method has no target")
+
+// Collect a notif for a digest method, or push it now if it's urgent
+func collectDigest(db *sql.DB, q *deliveryQueue, user notif.Userinfo, m Method, n notif.Notif, now time.Time) error {
+	var target Method
+
+	if n.Priority == notif.PriRoutine || n.Priority == notif.PriInformational {
+		return insertJob(db, n, m, JobDigest)
+	}
+
+	if m.Target == 0 {
+		return errNoDigestTarget
+	}
+	err := findMethod(db, m.Target, &target)
+	if err != nil {
+		return err
+	}
+	if target.Mode == ModeDigest {
+		return errors.New("digest method targets another digest")
+	}
+	if quietHold(user, target, n, now) {
+		return q.hold(n, target)
+	}
+	return q.enqueue(n, target)
+}
+
+// The most recent time a user's digest was scheduled to go out
+func lastDigestTime(user notif.Userinfo, now time.Time) time.Time {
+	t := now.In(userLocation(user))
+	if user.DigestSchedule == "hourly" {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	}
+	d := time.Date(t.Year(), t.Month(), t.Day(), user.DigestHour, 0, 0, 0, t.Location())
+	if d.After(t) {
+		d = d.AddDate(0, 0, -1)
+	}
+	return d
+}
+
+// Send digests for users with notifs collected before their last
+// scheduled digest time; run every digestInterval
+func sendDigests(db *sql.DB, q *deliveryQueue) {
+	oldest := make(map[int]time.Time)
+
+	rows, err := db.Query(`SELECT user_id, MIN(created) FROM delivery WHERE state = $1 GROUP BY user_id`, JobDigest)
+	if err != nil {
+		fmt.Println("Digest: Collected delivery query error: ", err)
+		return
+	}
+	for rows.Next() {
+		var id int
+		var created time.Time
+		if err = rows.Scan(&id, &created); err == nil {
+			oldest[id] = created
+		}
+	}
+	rows.Close()
+
+	now := time.Now()
+	for id, created := range oldest {
+		var user notif.Userinfo
+
+		err = findUser(db, id, &user)
+		if err != nil {
+			fmt.Println("Digest: Can't retrieve user info: ", err, " user ", id)
+			continue
+		}
+		if created.Before(lastDigestTime(user, now)) {
+			sendDigest(db, q, user)
+		}
+	}
+}
+
+// Send a summary of a user's collected notifs for each digest method
+func sendDigest(db *sql.DB, q *deliveryQueue, user notif.Userinfo) {
+	var m Method
+	var target Method
+	now := time.Now()
+
+	methods, held, err := findHeld(db, user.UserID, JobDigest)
+	if err != nil {
+		fmt.Println("Digest: Collected delivery query error: ", err)
+		return
+	}
+
+	for _, methodID := range methods {
+		live := liveJobs(db, held[methodID], JobDigest, now)
+		if len(live) == 0 {
+			continue
+		}
+
+		err = digestTarget(db, methodID, &m, &target)
+		if err == sql.ErrNoRows || err == errNoDigestTarget {
+			// Nothing to send the digest by; don't try again every time
+			fmt.Println("Digest: Cancelling ", len(live), " notif(s) for method ", methodID, ": ", err)
+			cancelJobs(db, live, JobDigest)
+			continue
+		}
+		if err != nil {
+			fmt.Println("Digest: Method query error: ", err, " method ", methodID)
+			continue
+		}
+		err = summarizeJobs(db, user, live, JobDigest, target, "digest", now)
+		if err != nil {
+			fmt.Println("Digest: Summary error: ", err)
+		}
+	}
+	q.nudge()
+}
+
+// Find a digest method and the method its digests are sent by
+func digestTarget(db *sql.DB, methodID int, m *Method, target *Method) error {
+	err := findMethod(db, methodID, m)
+	if err != nil {
+		return err
+	}
+	if m.Target == 0 {
+		return errNoDigestTarget
+	}
+	err = findMethod(db, m.Target, target)
+	if err != nil {
+		return err
+	}
+	if target.Mode == ModeDigest {
+		return errNoDigestTarget
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql/driver"
+	"github.com/jimfenton/notif-agent/notif"
+	"testing"
+	"time"
+)
+
+// A row of method as selected by findMethod
+func methodRow(id int, mode int, target interface{}) []driver.Value {
+	return []driver.Value{int64(id), int64(7), true, "Method", int64(mode), "+15555550100", "", nil, target}
+}
+
+func TestSendDigest(t *testing.T) {
+	allDay := []notif.QuietWindow{{Days: 0, StartHour: 0, EndHour: 0}}
+
+	tests := []struct {
+		name   string
+		target []driver.Value // Row for the target method, nil if missing
+		quiet  []notif.QuietWindow
+		state  string // Of the summary's delivery job; "" if none
+	}{
+		{name: "sent", target: methodRow(3, int(ModeText), nil), state: JobPending},
+		{name: "quiet hours", target: methodRow(3, int(ModeText), nil), quiet: allDay, state: JobHeld},
+		{name: "quiet hours email", target: methodRow(3, int(ModeEmail), nil), quiet: allDay, state: JobPending},
+		{name: "missing target"},
+		{name: "digest target", target: methodRow(3, int(ModeDigest), nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			f.rows("FROM delivery WHERE state = $1 AND user_id", []driver.Value{int64(11), testNotID, int64(2)})
+			f.rows("FROM notification WHERE notid", notifRow(time.Now().Add(-10*time.Minute), false))
+			if tt.target != nil {
+				f.rows("FROM method WHERE id", tt.target)
+			}
+			f.rowsOnce("FROM method WHERE id", methodRow(2, int(ModeDigest), int64(3)))
+			user := notif.Userinfo{UserID: 7, Quiet: tt.quiet}
+
+			sendDigest(db, newDeliveryQueue(db, notif.Siteinfo{}), user)
+
+			jobs := f.args("INSERT INTO delivery")
+			cancelled := false
+			for _, a := range f.args("UPDATE delivery SET state") {
+				cancelled = cancelled || a[0] == JobCancelled
+			}
+			if tt.state == "" {
+				if len(jobs) != 0 || !cancelled {
+					t.Errorf("%d summaries queued, cancelled %v; want collected notifs cancelled", len(jobs), cancelled)
+				}
+				return
+			}
+			if len(jobs) != 1 || cancelled {
+				t.Fatalf("%d summaries queued, cancelled %v; want one summary", len(jobs), cancelled)
+			}
+			if jobs[0][3] != tt.state {
+				t.Errorf("summary job %v, want state %q", jobs[0][3], tt.state)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+/*
+
+dkim.go - DKIM key record parsing for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* Notifier keys are published in DNS as DKIM key records (RFC 6376
+section 3.6.1, RFC 8463), which use the DKIM tag-list syntax of
+section 3.2: tag=value pairs separated by semicolons, with folding
+white space allowed around tags and values. */
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errKeyRevoked = errors.New("signature key revoked")
+
+type tagSpec struct {
+	Name  string
+	Value string
+}
+
+// A parsed DKIM key record
+type keyRecord struct {
+	Version  string   // v=, empty if absent
+	KeyType  string   // k=, default rsa
+	Hashes   []string // h=, nil means any
+	Services []string // s=, default *
+	Flags    []string // t=
+	Notes    string   // n=
+	Key      []byte   // p=, decoded; empty if revoked
+}
+
+// Whether the signer is testing DKIM (t=y)
+func (kr *keyRecord) Testing() bool {
+	return hasValue(kr.Flags, "y")
+}
+
+// Extract the public key from the TXT records found at a key's name.
+// Each string must already be joined from its DNS character-strings.
+func decodeKeyRecord(records []string) (crypto.PublicKey, error) {
+	switch len(records) {
+	case 0:
+		return nil, errKeyNotFound
+	case 1:
+	default:
+		return nil, fmt.Errorf("%d TXT records found where one key record expected", len(records))
+	}
+
+	kr, err := parseKeyRecord(records[0])
+	if err != nil {
+		return nil, err
+	}
+	if kr.Testing() {
+		fmt.Println("Signature key is in testing mode (t=y)")
+	}
+	return parsePublicKey(kr.KeyType, kr.Key)
+}
+
+// Parse and check a DKIM key record
+func parseKeyRecord(txt string) (*keyRecord, error) {
+	kr := &keyRecord{KeyType: "rsa", Services: []string{"*"}}
+
+	tags, err := parseTagList(txt)
+	if err != nil {
+		return nil, err
+	}
+
+	havekey := false
+	for i, t := range tags {
+		switch t.Name {
+		case "v":
+			if i != 0 {
+				return nil, errors.New("v= tag must come first")
+			}
+			if t.Value != "DKIM1" {
+				return nil, errors.New("unsupported key record version " + t.Value)
+			}
+			kr.Version = t.Value
+		case "k":
+			kr.KeyType = t.Value
+		case "h":
+			kr.Hashes = splitValueList(t.Value)
+		case "s":
+			kr.Services = splitValueList(t.Value)
+		case "t":
+			kr.Flags = splitValueList(t.Value)
+		case "n":
+			kr.Notes = t.Value
+		case "p":
+			havekey = true
+			kr.Key, err = base64.StdEncoding.DecodeString(stripFWS(t.Value))
+			if err != nil {
+				return nil, fmt.Errorf("public key decode error: %v", err)
+			}
+		}
+		// Unrecognized tags are ignored
+	}
+
+	if !havekey {
+		return nil, errors.New("key record has no p= tag")
+	}
+	if len(kr.Key) == 0 {
+		return nil, errKeyRevoked
+	}
+	if kr.KeyType != "rsa" && kr.KeyType != "ed25519" && kr.KeyType != "ec" {
+		return nil, errors.New("unsupported key type " + kr.KeyType)
+	}
+	if kr.Hashes != nil && !hasValue(kr.Hashes, "sha256") {
+		return nil, errors.New("key not usable with sha256")
+	}
+	if !hasValue(kr.Services, "*") && !hasValue(kr.Services, "notif") {
+		return nil, errors.New("key not for notif service")
+	}
+	return kr, nil
+}
+
+// Split a DKIM tag-list into its tags, in order. A trailing semicolon
+// is allowed; empty or duplicate tags are errors.
+func parseTagList(s string) ([]tagSpec, error) {
+	var tags []tagSpec
+	seen := make(map[string]bool)
+
+	specs := strings.Split(s, ";")
+	if len(specs) > 1 && trimFWS(specs[len(specs)-1]) == "" {
+		specs = specs[:len(specs)-1]
+	}
+
+	for _, spec := range specs {
+		eq := strings.IndexByte(spec, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("tag-spec %q has no '='", trimFWS(spec))
+		}
+		name := trimFWS(spec[:eq])
+		value := trimFWS(spec[eq+1:])
+
+		if !validTagName(name) {
+			return nil, fmt.Errorf("invalid tag name %q", name)
+		}
+		for i := 0; i < len(value); i++ {
+			c := value[i]
+			if !(c >= 0x21 && c <= 0x7e) && c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				return nil, fmt.Errorf("invalid character in value of tag %s", name)
+			}
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate tag %s", name)
+		}
+		seen[name] = true
+		tags = append(tags, tagSpec{name, value})
+	}
+	return tags, nil
+}
+
+// tag-name = ALPHA *ALNUMPUNC, where ALNUMPUNC is a letter, digit or "_"
+func validTagName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		isalpha := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !isalpha && (i == 0 || !((c >= '0' && c <= '9') || c == '_')) {
+			return false
+		}
+	}
+	return true
+}
+
+// Split a colon-separated value list such as h=sha1:sha256
+func splitValueList(value string) []string {
+	var list []string
+
+	for _, v := range strings.Split(value, ":") {
+		list = append(list, trimFWS(v))
+	}
+	return list
+}
+
+func hasValue(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func trimFWS(s string) string {
+	return strings.Trim(s, " \t\r\n")
+}
+
+func stripFWS(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
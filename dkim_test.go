@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/miekg/dns"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Base64 public keys of each supported type, as published in p=
+func testDKIMKeys(t testing.TB) (rsaKey, ecKey, edKey string) {
+	rk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey = base64.StdEncoding.EncodeToString(der)
+
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.MarshalPKIXPublicKey(&ek.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey = base64.StdEncoding.EncodeToString(der)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey = base64.StdEncoding.EncodeToString(pub)
+	return
+}
+
+func TestParseKeyRecord(t *testing.T) {
+	rsaKey, ecKey, edKey := testDKIMKeys(t)
+
+	tests := []struct {
+		name     string
+		txt      string
+		keyType  string
+		hashes   []string
+		services []string
+		testing  bool
+		err      string // Substring of the expected error
+	}{
+		{name: "minimal", txt: "p=" + rsaKey, keyType: "rsa", services: []string{"*"}},
+		{name: "ed25519", txt: "v=DKIM1; k=ed25519; p=" + edKey, keyType: "ed25519", services: []string{"*"}},
+		{name: "ec", txt: "v=DKIM1; k=ec; p=" + ecKey, keyType: "ec", services: []string{"*"}},
+		{name: "trailing semicolon", txt: "v=DKIM1; k=ed25519; p=" + edKey + ";", keyType: "ed25519", services: []string{"*"}},
+		{name: "folding white space", txt: "v = DKIM1 ;\r\n\tk = ed25519 ; p = " + edKey[:20] + " \r\n " + edKey[20:],
+			keyType: "ed25519", services: []string{"*"}},
+		{name: "unknown tags ignored", txt: "v=DKIM1; x_y=whatever; k=ed25519; p=" + edKey, keyType: "ed25519", services: []string{"*"}},
+		{name: "notes", txt: "v=DKIM1; n=Contact admin@example.com; k=ed25519; p=" + edKey, keyType: "ed25519", services: []string{"*"}},
+
+		{name: "h= list", txt: "k=ed25519; h=sha1:sha256; p=" + edKey,
+			keyType: "ed25519", hashes: []string{"sha1", "sha256"}, services: []string{"*"}},
+		{name: "h= list with spaces", txt: "k=ed25519; h= sha1 : sha256 ; p=" + edKey,
+			keyType: "ed25519", hashes: []string{"sha1", "sha256"}, services: []string{"*"}},
+		{name: "h= without sha256", txt: "k=ed25519; h=sha1; p=" + edKey, err: "sha256"},
+		{name: "s= list", txt: "k=ed25519; s=email:notif; p=" + edKey,
+			keyType: "ed25519", services: []string{"email", "notif"}},
+		{name: "s= any", txt: "k=ed25519; s=*; p=" + edKey, keyType: "ed25519", services: []string{"*"}},
+		{name: "s= email only", txt: "k=ed25519; s=email; p=" + edKey, err: "notif service"},
+
+		{name: "t=y", txt: "k=ed25519; t=y; p=" + edKey, keyType: "ed25519", services: []string{"*"}, testing: true},
+		{name: "t=s:y", txt: "k=ed25519; t=s:y; p=" + edKey, keyType: "ed25519", services: []string{"*"}, testing: true},
+		{name: "t=s", txt: "k=ed25519; t=s; p=" + edKey, keyType: "ed25519", services: []string{"*"}},
+
+		{name: "revoked", txt: "v=DKIM1; k=ed25519; p=", err: errKeyRevoked.Error()},
+		{name: "revoked with space", txt: "v=DKIM1; p= ;", err: errKeyRevoked.Error()},
+		{name: "no p=", txt: "v=DKIM1; k=ed25519", err: "no p="},
+		{name: "v= not first", txt: "k=ed25519; v=DKIM1; p=" + edKey, err: "first"},
+		{name: "bad version", txt: "v=DKIM2; p=" + edKey, err: "version"},
+		{name: "unknown key type", txt: "k=dsa; p=" + edKey, err: "key type"},
+		{name: "bad base64", txt: "k=ed25519; p=not*base64", err: "decode"},
+		{name: "duplicate tag", txt: "k=ed25519; k=rsa; p=" + edKey, err: "duplicate"},
+		{name: "missing =", txt: "k=ed25519; bogus; p=" + edKey, err: "no '='"},
+		{name: "empty tag", txt: "k=ed25519;; p=" + edKey, err: "no '='"},
+		{name: "bad tag name", txt: "1k=ed25519; p=" + edKey, err: "tag name"},
+		{name: "control character", txt: "n=a\x01b; p=" + edKey, err: "invalid character"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kr, err := parseKeyRecord(tt.txt)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseKeyRecord: %v", err)
+			}
+			if kr.KeyType != tt.keyType {
+				t.Errorf("key type %q, want %q", kr.KeyType, tt.keyType)
+			}
+			if !reflect.DeepEqual(kr.Hashes, tt.hashes) {
+				t.Errorf("hashes %q, want %q", kr.Hashes, tt.hashes)
+			}
+			if !reflect.DeepEqual(kr.Services, tt.services) {
+				t.Errorf("services %q, want %q", kr.Services, tt.services)
+			}
+			if kr.Testing() != tt.testing {
+				t.Errorf("testing %v, want %v", kr.Testing(), tt.testing)
+			}
+			if _, err := parsePublicKey(kr.KeyType, kr.Key); err != nil {
+				t.Errorf("parsePublicKey: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeKeyRecord(t *testing.T) {
+	_, _, edKey := testDKIMKeys(t)
+	good := "v=DKIM1; k=ed25519; p=" + edKey
+
+	if _, err := decodeKeyRecord([]string{good}); err != nil {
+		t.Errorf("one record: %v", err)
+	}
+	if _, err := decodeKeyRecord(nil); !errors.Is(err, errKeyNotFound) {
+		t.Errorf("no records: error %v, want %v", err, errKeyNotFound)
+	}
+	_, err := decodeKeyRecord([]string{good, good})
+	if err == nil || !strings.Contains(err.Error(), "2 TXT records") {
+		t.Errorf("two records: error %v, want one naming the count", err)
+	}
+	if _, err := decodeKeyRecord([]string{"v=DKIM1; p="}); !errors.Is(err, errKeyRevoked) {
+		t.Errorf("revoked: error %v, want %v", err, errKeyRevoked)
+	}
+}
+
+// Records split into several character-strings are joined before parsing
+func TestTXTAnswerSplitStrings(t *testing.T) {
+	rsaKey, _, edKey := testDKIMKeys(t)
+	hdr := func(ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: "sel._domainkey.example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	answer := []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "sel._domainkey.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: "keys.example.net."},
+		&dns.TXT{Hdr: hdr(3600), Txt: []string{"v=DKIM1; k=rsa; p=" + rsaKey[:100], rsaKey[100:200], rsaKey[200:]}},
+	}
+	records, ttl := txtAnswer(answer)
+	if len(records) != 1 {
+		t.Fatalf("%d records, want 1", len(records))
+	}
+	if ttl != time.Hour {
+		t.Errorf("TTL %v, want 1h", ttl)
+	}
+	if _, err := decodeKeyRecord(records); err != nil {
+		t.Errorf("split record: %v", err)
+	}
+
+	// Two records (e.g. during a sloppy rotation) are refused, and the
+	// lower TTL is used
+	answer = append(answer, &dns.TXT{Hdr: hdr(300), Txt: []string{"v=DKIM1; k=ed25519; ", "p=" + edKey}})
+	records, ttl = txtAnswer(answer)
+	if len(records) != 2 || ttl != 5*time.Minute {
+		t.Fatalf("%d records, TTL %v; want 2, 5m", len(records), ttl)
+	}
+	if _, err := decodeKeyRecord(records); err == nil {
+		t.Error("two records accepted")
+	}
+}
+
+func FuzzParseKeyRecord(f *testing.F) {
+	rsaKey, ecKey, edKey := testDKIMKeys(f)
+	for _, seed := range []string{
+		"p=" + rsaKey,
+		"v=DKIM1; k=ec; p=" + ecKey,
+		"v=DKIM1; k=ed25519; h=sha1:sha256; s=email:notif; t=y:s; n=note; p=" + edKey + ";",
+		"v = DKIM1 ;\r\n\tk = ed25519 ; p = " + edKey,
+		"v=DKIM1; p=",
+		"k=ed25519;; p=",
+		"=;=;",
+		"v=DKIM1; k=rsa; k=rsa",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, txt string) {
+		kr, err := parseKeyRecord(txt)
+		if err != nil {
+			if kr != nil {
+				t.Errorf("record returned with error %v", err)
+			}
+			return
+		}
+		if len(kr.Key) == 0 {
+			t.Error("accepted record without key")
+		}
+		if kr.KeyType != "rsa" && kr.KeyType != "ed25519" && kr.KeyType != "ec" {
+			t.Errorf("accepted key type %q", kr.KeyType)
+		}
+		if kr.Hashes != nil && !hasValue(kr.Hashes, "sha256") {
+			t.Errorf("accepted hashes %q", kr.Hashes)
+		}
+		if !hasValue(kr.Services, "*") && !hasValue(kr.Services, "notif") {
+			t.Errorf("accepted services %q", kr.Services)
+		}
+
+		// Tags are found again when the list is reassembled
+		tags, err := parseTagList(txt)
+		if err != nil {
+			t.Fatalf("tag list rejected after record accepted: %v", err)
+		}
+		var b strings.Builder
+		for _, tag := range tags {
+			b.WriteString(tag.Name + "=" + tag.Value + ";")
+		}
+		again, err := parseTagList(b.String())
+		if err != nil || !reflect.DeepEqual(again, tags) {
+			t.Errorf("reassembled tag list %q parsed as %v, %v", b.String(), again, err)
+		}
+	})
+}
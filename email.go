@@ -0,0 +1,221 @@
+/*
+
+email.go - Email push for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of Userinfo.EmailSecurity
+const (
+	SecurityNone     = iota // Plaintext SMTP
+	SecurityStartTLS        // Upgrade to TLS with STARTTLS
+	SecurityTLS             // Implicit TLS (SMTPS)
+)
+
+// Values of Userinfo.EmailAuthentication
+const (
+	AuthNone    = iota // No SMTP authentication
+	AuthPlain          // AUTH PLAIN (only sent over TLS or to localhost)
+	AuthCRAMMD5        // AUTH CRAM-MD5
+)
+
+const emailTimeout = 30 * time.Second
+
+// Roots trusted for the SMTP server's certificate; nil for the system's
+var emailRootCAs *x509.CertPool
+
+type emailDeliverer struct{}
+
+func init() {
+	registerDeliverer(ModeEmail, emailDeliverer{})
+}
+
+func (emailDeliverer) Deliver(m Method, n notif.Notif, user notif.Userinfo, site notif.Siteinfo) DeliveryResult {
+	err := sendEmail(m, n, user)
+	if err == nil {
+		return deliverySent()
+	}
+
+	// 4xx SMTP replies and network trouble are transient; 5xx replies and
+	// problems with the user's settings are not.
+	if te, ok := err.(*textproto.Error); ok {
+		if te.Code >= 400 && te.Code < 500 {
+			return retryableFailure(err)
+		}
+		return permanentFailure(err)
+	}
+	if _, ok := err.(net.Error); ok {
+		return retryableFailure(err)
+	}
+	return permanentFailure(err)
+}
+
+// Send a notif as an email message using the user's SMTP settings
+func sendEmail(m Method, n notif.Notif, user notif.Userinfo) error {
+	if m.Address == "" {
+		return errors.New("method address empty")
+	}
+	if user.EmailServer == "" {
+		return errors.New("user email server empty")
+	}
+
+	from := user.EmailFrom
+	if from == "" {
+		from = user.EmailUsername
+	}
+	if from == "" {
+		return errors.New("user 'from' address empty")
+	}
+
+	port := user.EmailPort
+	if port == 0 {
+		switch user.EmailSecurity {
+		case SecurityStartTLS:
+			port = 587
+		case SecurityTLS:
+			port = 465
+		default:
+			port = 25
+		}
+	}
+	addr := net.JoinHostPort(user.EmailServer, strconv.Itoa(port))
+	tlsconfig := &tls.Config{ServerName: user.EmailServer, RootCAs: emailRootCAs}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: emailTimeout}
+
+	switch user.EmailSecurity {
+	case SecurityNone, SecurityStartTLS:
+		conn, err = dialer.Dial("tcp", addr)
+	case SecurityTLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsconfig)
+	default:
+		return fmt.Errorf("unknown email security mode %d", user.EmailSecurity)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+
+	c, err := smtp.NewClient(conn, user.EmailServer)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if user.EmailSecurity == SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("server does not support STARTTLS")
+		}
+		if err = c.StartTLS(tlsconfig); err != nil {
+			return err
+		}
+	}
+
+	switch user.EmailAuthentication {
+	case AuthNone:
+	case AuthPlain:
+		err = c.Auth(smtp.PlainAuth("", user.EmailUsername, user.EmailPassword, user.EmailServer))
+	case AuthCRAMMD5:
+		err = c.Auth(smtp.CRAMMD5Auth(user.EmailUsername, user.EmailPassword))
+	default:
+		err = fmt.Errorf("unknown email authentication mode %d", user.EmailAuthentication)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	if err = c.Rcpt(m.Address); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = wc.Write(emailMessage(m, n, from)); err != nil {
+		wc.Close()
+		return err
+	}
+	if err = wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Compose the RFC 5322 message for a notif. Line endings are converted
+// to CRLF (and leading dots escaped) by the SMTP data writer.
+func emailMessage(m Method, n notif.Notif, from string) []byte {
+	var b bytes.Buffer
+
+	subject := n.Subject
+	if m.Preamble != "" {
+		subject = m.Preamble + ": " + subject
+	}
+
+	fmt.Fprintf(&b, "From: %s\n", from)
+	fmt.Fprintf(&b, "To: %s\n", m.Address)
+	fmt.Fprintf(&b, "Subject: %s\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\n")
+	fmt.Fprintf(&b, "Content-Transfer-Encoding: 8bit\n")
+	fmt.Fprintf(&b, "X-Notif-Priority: %s\n", n.Priority)
+	fmt.Fprintf(&b, "X-Notif-From: %s\n", mime.QEncoding.Encode("utf-8", n.From))
+	if n.NotID != "" {
+		fmt.Fprintf(&b, "X-Notif-ID: %s\n", n.NotID)
+	}
+	fmt.Fprintf(&b, "\n")
+
+	if m.Preamble != "" {
+		fmt.Fprintf(&b, "%s\n\n", m.Preamble)
+	}
+	fmt.Fprintf(&b, "From: %s\n", n.From)
+	fmt.Fprintf(&b, "Priority: %s\n", n.Priority)
+	fmt.Fprintf(&b, "Subject: %s\n\n", n.Subject)
+	b.WriteString(strings.TrimRight(n.Body, "\r\n"))
+	b.WriteString("\n")
+
+	return b.Bytes()
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/jimfenton/notif-agent/notif"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// What the fake SMTP server saw of a session
+type smtpSession struct {
+	TLS  bool   // Session was encrypted when the message was sent
+	Auth string // Mechanism the client authenticated with
+	From string
+	To   string
+	Data string
+	Err  string // Protocol problem found by the server
+}
+
+type fakeSMTP struct {
+	Addr     string
+	Port     int
+	TLS      *tls.Config
+	Implicit bool // TLS from the start rather than by STARTTLS
+	User     string
+	Password string
+	Done     chan smtpSession
+	ln       net.Listener
+}
+
+// A self-signed certificate for 127.0.0.1, and a pool trusting it
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func startSMTP(t *testing.T, f *fakeSMTP) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Implicit {
+		ln = tls.NewListener(ln, f.TLS)
+	}
+	f.ln = ln
+	f.Addr = ln.Addr().String()
+	_, port, _ := net.SplitHostPort(f.Addr)
+	f.Port, _ = strconv.Atoi(port)
+	f.Done = make(chan smtpSession, 1)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		f.Done <- f.serve(conn)
+	}()
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) (s smtpSession) {
+	s.TLS = f.Implicit
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	read := func() string {
+		line, _ := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n")
+	}
+
+	reply("220 127.0.0.1 ESMTP fake")
+	for {
+		line := read()
+		cmd := strings.ToUpper(line)
+		switch {
+		case line == "":
+			s.Err = "connection closed"
+			return
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-127.0.0.1")
+			if f.TLS != nil && !s.TLS {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN CRAM-MD5")
+		case cmd == "STARTTLS":
+			reply("220 Go ahead")
+			tc := tls.Server(conn, f.TLS)
+			if err := tc.Handshake(); err != nil {
+				s.Err = "handshake: " + err.Error()
+				return
+			}
+			conn = tc
+			r = bufio.NewReader(conn)
+			s.TLS = true
+		case strings.HasPrefix(cmd, "AUTH PLAIN"):
+			resp, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(line[len("AUTH PLAIN"):]))
+			if string(resp) != "\x00"+f.User+"\x00"+f.Password {
+				reply("535 Authentication failed")
+				continue
+			}
+			s.Auth = "PLAIN"
+			reply("235 OK")
+		case cmd == "AUTH CRAM-MD5":
+			challenge := "<1234.5678@127.0.0.1>"
+			reply("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+			resp, _ := base64.StdEncoding.DecodeString(read())
+			mac := hmac.New(md5.New, []byte(f.Password))
+			mac.Write([]byte(challenge))
+			if string(resp) != f.User+" "+hex.EncodeToString(mac.Sum(nil)) {
+				reply("535 Authentication failed")
+				continue
+			}
+			s.Auth = "CRAM-MD5"
+			reply("235 OK")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.From = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.To = strings.Trim(line[len("RCPT TO:"):], "<> ")
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 Go ahead")
+			var b strings.Builder
+			for l := read(); l != "."; l = read() {
+				b.WriteString(l + "\n")
+			}
+			s.Data = b.String()
+			reply("250 Queued")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Unknown command")
+		}
+	}
+}
+
+func TestSendEmail(t *testing.T) {
+	cert, pool := testCert(t)
+	emailRootCAs = pool
+	defer func() { emailRootCAs = nil }()
+	tlsconfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	tests := []struct {
+		name     string
+		security int
+		auth     int
+		wantTLS  bool
+		wantAuth string
+	}{
+		{"plain", SecurityNone, AuthNone, false, ""},
+		{"plain auth plain", SecurityNone, AuthPlain, false, "PLAIN"},
+		{"starttls", SecurityStartTLS, AuthNone, true, ""},
+		{"starttls auth plain", SecurityStartTLS, AuthPlain, true, "PLAIN"},
+		{"starttls cram-md5", SecurityStartTLS, AuthCRAMMD5, true, "CRAM-MD5"},
+		{"implicit tls cram-md5", SecurityTLS, AuthCRAMMD5, true, "CRAM-MD5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSMTP{User: "alice", Password: "secret", Implicit: tt.security == SecurityTLS}
+			if tt.security != SecurityNone {
+				f.TLS = tlsconfig
+			}
+			startSMTP(t, f)
+
+			user := notif.Userinfo{
+				EmailServer:         "127.0.0.1",
+				EmailPort:           f.Port,
+				EmailSecurity:       tt.security,
+				EmailAuthentication: tt.auth,
+				EmailUsername:       "alice",
+				EmailPassword:       "secret",
+				EmailFrom:           "agent@example.org",
+			}
+			m := Method{Mode: ModeEmail, Address: "alice@example.net", Preamble: "Notif"}
+			n := notif.Notif{Subject: "Door open", Body: "The garage door is open.", From: "alarm.example.com",
+				Priority: notif.PriPriority, NotID: "1b4e28ba-2fa1-11d2-883f-0016d3cca427"}
+
+			if err := sendEmail(m, n, user); err != nil {
+				t.Fatalf("sendEmail: %v", err)
+			}
+			s := <-f.Done
+			if s.Err != "" {
+				t.Fatalf("server: %s", s.Err)
+			}
+			if s.TLS != tt.wantTLS {
+				t.Errorf("TLS = %v, want %v", s.TLS, tt.wantTLS)
+			}
+			if s.Auth != tt.wantAuth {
+				t.Errorf("auth = %q, want %q", s.Auth, tt.wantAuth)
+			}
+			if s.From != "agent@example.org" || s.To != "alice@example.net" {
+				t.Errorf("envelope = %s -> %s", s.From, s.To)
+			}
+			for _, want := range []string{
+				"Subject: Notif: Door open\n",
+				"X-Notif-Priority: Priority\n",
+				"X-Notif-From: alarm.example.com\n",
+				"X-Notif-ID: 1b4e28ba-2fa1-11d2-883f-0016d3cca427\n",
+				"\nNotif\n\n",
+				"From: alarm.example.com\n",
+				"The garage door is open.\n",
+			} {
+				if !strings.Contains(s.Data, want) {
+					t.Errorf("message lacks %q:\n%s", want, s.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestSendEmailAuthFailure(t *testing.T) {
+	f := &fakeSMTP{User: "alice", Password: "secret"}
+	startSMTP(t, f)
+
+	user := notif.Userinfo{EmailServer: "127.0.0.1", EmailPort: f.Port, EmailAuthentication: AuthCRAMMD5,
+		EmailUsername: "alice", EmailPassword: "wrong", EmailFrom: "agent@example.org"}
+	m := Method{Mode: ModeEmail, Address: "alice@example.net"}
+
+	res := emailDeliverer{}.Deliver(m, notif.Notif{Subject: "x"}, user, notif.Siteinfo{})
+	if res.Status != DeliveryPermanentFailure {
+		t.Errorf("status = %s, want permanent failure (%v)", res.Status, res.Err)
+	}
+}
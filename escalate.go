@@ -0,0 +1,271 @@
+/*
+
+escalate.go - Escalation of urgent notifs for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* An escalation policy is an ordered list of steps, each pushing the
+notif by one method. The first step runs its delay after the notif
+arrives, and each later step runs its delay after the last push of the
+step before. A step may be repeated a number of times at an interval.
+Escalation stops as soon as the notif is read, deleted or expires. Only
+Emergency and Priority notifs are escalated.
+
+The progress of each escalation is kept in the escalation_run table,
+so the escalator carries on where it left off after a restart. */
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"time"
+)
+
+// Values of the escalation_run.state column
+const (
+	RunActive  = "active"  // Waiting for next_time
+	RunDone    = "done"    // All steps pushed
+	RunStopped = "stopped" // Notif read, deleted or expired
+)
+
+const escalatePoll = 10 * time.Second // Interval between scans for due steps
+
+type escalationStep struct {
+	MethodID int //Database: "method_id"
+	Delay    int //Database: "delay" (seconds)
+	Repeat   int //Database: "repeat" (pushes after the first)
+	Interval int //Database: "repeat_interval" (seconds)
+}
+
+type escalationRun struct {
+	Id           int
+	NotID        string
+	EscalationID int
+	UserID       int
+	Step         int // Index into the policy's steps
+	Pushes       int // Pushes so far of the current step
+}
+
+type escalator struct {
+	*worker
+	Db    *sql.DB
+	Queue *deliveryQueue
+	wake  chan struct{}
+}
+
+func newEscalator(db *sql.DB, q *deliveryQueue) *escalator {
+	return &escalator{worker: newWorker(), Db: db, Queue: q, wake: make(chan struct{}, 1)}
+}
+
+// Whether a notif is urgent enough to escalate
+func escalates(n notif.Notif) bool {
+	return n.Priority == notif.PriEmergency || n.Priority == notif.PriPriority
+}
+
+// Find the steps of an escalation policy, in order
+func findSteps(db *sql.DB, escalationID int) ([]escalationStep, error) {
+	var steps []escalationStep
+
+	rows, err := db.Query(`SELECT method_id, delay, repeat, repeat_interval FROM escalation_step WHERE escalation_id = $1 ORDER BY seq, id`, escalationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s escalationStep
+		err = rows.Scan(&s.MethodID, &s.Delay, &s.Repeat, &s.Interval)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, s)
+	}
+	return steps, rows.Err()
+}
+
+// Start escalating a notif under a policy, unless it's already being
+// escalated under that policy (e.g. it has been revised)
+func (e *escalator) start(n notif.Notif, escalationID int) error {
+	steps, err := findSteps(e.Db, escalationID)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		return errors.New("escalation has no steps")
+	}
+
+	now := time.Now()
+	res, err := e.Db.Exec(`INSERT INTO escalation_run (notid,escalation_id,user_id,step,pushes,next_time,state,created) VALUES ($1,$2,$3,0,0,$4,$5,$6) ON CONFLICT (notid, escalation_id) WHERE state = 'active' DO NOTHING`,
+		n.NotID, escalationID, n.UserID, now.Add(seconds(steps[0].Delay)), RunActive, now)
+	if err != nil {
+		return err
+	}
+	if added, err := res.RowsAffected(); err == nil && added > 0 {
+		e.nudge()
+	}
+	return nil
+}
+
+// Stop any escalation of a notif
+func (e *escalator) cancel(notid string) error {
+	_, err := e.Db.Exec(`UPDATE escalation_run SET state = $1 WHERE notid = $2 AND state = $3`, RunStopped, notid, RunActive)
+	return err
+}
+
+// Wake the escalator without waiting for the next poll
+func (e *escalator) nudge() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Escalator; runs until stop is called
+func (e *escalator) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(escalatePoll)
+	defer ticker.Stop()
+
+	for {
+		e.runDue()
+		select {
+		case <-ticker.C:
+		case <-e.wake:
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+// Carry out every escalation step that is due
+func (e *escalator) runDue() {
+	var runs []escalationRun
+
+	rows, err := e.Db.Query(`SELECT id,notid,escalation_id,user_id,step,pushes FROM escalation_run WHERE state = $1 AND next_time <= $2 ORDER BY next_time`,
+		RunActive, time.Now())
+	if err != nil {
+		fmt.Println("Escalate: Run query error: ", err)
+		return
+	}
+	for rows.Next() {
+		var r escalationRun
+		err = rows.Scan(&r.Id, &r.NotID, &r.EscalationID, &r.UserID, &r.Step, &r.Pushes)
+		if err != nil {
+			fmt.Println("Escalate: Run scan error: ", err)
+			continue
+		}
+		runs = append(runs, r)
+	}
+	rows.Close()
+
+	for _, r := range runs {
+		e.advance(r)
+	}
+}
+
+// Push the current step of an escalation and schedule the next push
+func (e *escalator) advance(r escalationRun) {
+	var n notif.Notif
+	var m Method
+	var user notif.Userinfo
+
+	now := time.Now()
+
+	err := findNotif(e.Db, r.NotID, &n)
+	if err != nil {
+		fmt.Println("Escalate: Notif ", r.NotID, " not found: ", err)
+		e.setState(r, RunStopped)
+		return
+	}
+	if n.Read || n.Deleted || n.Expired(now) {
+		e.setState(r, RunStopped)
+		return
+	}
+
+	steps, err := findSteps(e.Db, r.EscalationID)
+	if err != nil {
+		fmt.Println("Escalate: Step query error: ", err)
+		return
+	}
+	if r.Step >= len(steps) { // policy shortened since the last push
+		e.setState(r, RunDone)
+		return
+	}
+	s := steps[r.Step]
+
+	// Where the escalation goes from here
+	step, pushes, next, state := r.Step, r.Pushes+1, now, RunActive
+	if pushes <= s.Repeat {
+		next = now.Add(seconds(s.Interval))
+	} else {
+		step, pushes = step+1, 0
+		if step < len(steps) {
+			next = now.Add(seconds(steps[step].Delay))
+		} else {
+			state = RunDone
+		}
+	}
+
+	err = findMethod(e.Db, s.MethodID, &m)
+	if err != nil {
+		fmt.Println("Escalate: Method query error: ", err) // skip this push
+	}
+	jobState := JobPending
+	if err == nil && findUser(e.Db, r.UserID, &user) == nil && quietHold(user, m, n, now) {
+		jobState = JobHeld
+	}
+
+	// Record the push and the new position together, unless another
+	// pass got there first
+	err = inTx(e.Db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE escalation_run SET step = $1, pushes = $2, next_time = $3, state = $4 WHERE id = $5 AND step = $6 AND pushes = $7 AND state = $8`,
+			step, pushes, next, state, r.Id, r.Step, r.Pushes, RunActive)
+		if err != nil {
+			return err
+		}
+		if count, _ := res.RowsAffected(); count != 1 || m.Id == 0 {
+			return nil
+		}
+		return insertJob(tx, n, m, jobState)
+	})
+	if err != nil {
+		fmt.Println("Escalate: Run update error: ", err)
+		return
+	}
+	e.Queue.nudge()
+}
+
+func (e *escalator) setState(r escalationRun, state string) {
+	_, err := e.Db.Exec(`UPDATE escalation_run SET state = $1 WHERE id = $2`, state, r.Id)
+	if err != nil {
+		fmt.Println("Escalate: Run update error: ", err)
+	}
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/jimfenton/notif-agent/notif"
+	"testing"
+	"time"
+)
+
+func TestEscalatorStart(t *testing.T) {
+	n := notif.Notif{NotID: testNotID, UserID: 7, Priority: notif.PriEmergency}
+
+	for _, running := range []bool{false, true} {
+		db, f := newFakeDB(t)
+		f.rows("FROM escalation_step", []driver.Value{int64(3), int64(0), int64(0), int64(0)})
+		if running { // Already escalating, e.g. a revision
+			f.on("INSERT INTO escalation_run", fakeResult{Affected: 0})
+		}
+		e := newEscalator(db, nil)
+
+		if err := e.start(n, 5); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+		if !f.ran("ON CONFLICT (notid, escalation_id) WHERE state = 'active' DO NOTHING") {
+			t.Error("second active run not prevented")
+		}
+		if woken := len(e.wake) == 1; woken == running {
+			t.Errorf("already running %v: escalator woken %v", running, woken)
+		}
+	}
+}
+
+func TestEscalatorStop(t *testing.T) {
+	db, f := newFakeDB(t)
+	e := newEscalator(db, nil)
+	go e.run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if !f.ran("FROM escalation_run") {
+		t.Error("due runs not checked")
+	}
+}
+
+func TestEscalatorAdvance(t *testing.T) {
+	fresh := func() []driver.Value { return notifRow(time.Now().Add(-time.Minute), false) }
+	read := fresh()
+	read[13] = true
+	steps := [][]driver.Value{
+		{int64(3), int64(0), int64(2), int64(60)},  // Method 3 now, then twice more a minute apart
+		{int64(4), int64(300), int64(0), int64(0)}, // Method 4 five minutes after that
+	}
+
+	tests := []struct {
+		name   string
+		notif  []driver.Value // nil if not found
+		step   int
+		pushes int
+		ends   bool // Without a push
+		lost   bool // Another pass advanced the run first
+		state  string
+		next   [2]int // Step and pushes after this one
+		after  int    // Seconds until the next push
+		method int    // Pushed, 0 if none
+	}{
+		{name: "read", notif: read, ends: true, state: RunStopped},
+		{name: "deleted", notif: notifRow(time.Now().Add(-time.Minute), true), ends: true, state: RunStopped},
+		{name: "expired", notif: notifRow(time.Now().Add(-2*time.Hour), false), ends: true, state: RunStopped},
+		{name: "not found", ends: true, state: RunStopped},
+		{name: "first push", notif: fresh(), state: RunActive, next: [2]int{0, 1}, after: 60, method: 3},
+		{name: "repeat", notif: fresh(), pushes: 1, state: RunActive, next: [2]int{0, 2}, after: 60, method: 3},
+		{name: "last repeat", notif: fresh(), pushes: 2, state: RunActive, next: [2]int{1, 0}, after: 300, method: 3},
+		{name: "last step", notif: fresh(), step: 1, state: RunDone, next: [2]int{2, 0}, method: 4},
+		{name: "policy shortened", notif: fresh(), step: 2, ends: true, state: RunDone},
+		{name: "lost race", notif: fresh(), lost: true, state: RunActive, next: [2]int{0, 1}, after: 60},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			if tt.notif != nil {
+				f.rows("FROM notification WHERE notid", tt.notif)
+			}
+			f.rows("FROM escalation_step", steps...)
+			f.rows("FROM method WHERE id", methodRow(3+tt.step, int(ModeText), nil))
+			if tt.lost {
+				f.on("UPDATE escalation_run SET step", fakeResult{Affected: 0})
+			}
+			e := newEscalator(db, newDeliveryQueue(db, notif.Siteinfo{}))
+
+			before := time.Now()
+			e.advance(escalationRun{Id: 8, NotID: testNotID, EscalationID: 5, UserID: 7, Step: tt.step, Pushes: tt.pushes})
+			after := time.Now()
+
+			updates := f.args("UPDATE escalation_run SET step")
+			stopped := f.args("UPDATE escalation_run SET state")
+			if tt.ends {
+				if len(updates) != 0 || len(stopped) != 1 || stopped[0][0] != tt.state {
+					t.Fatalf("run updated %v, state set %v; want state %q", updates, stopped, tt.state)
+				}
+			} else {
+				if len(updates) != 1 || len(stopped) != 0 {
+					t.Fatalf("run updated %v, state set %v; want one step update", updates, stopped)
+				}
+				u := updates[0]
+				if u[0] != int64(tt.next[0]) || u[1] != int64(tt.next[1]) || u[3] != tt.state {
+					t.Errorf("run moved to step %v push %v state %v, want %v %q", u[0], u[1], u[3], tt.next, tt.state)
+				}
+				if u[5] != int64(tt.step) || u[6] != int64(tt.pushes) {
+					t.Errorf("update conditional on step %v push %v, want %d %d", u[5], u[6], tt.step, tt.pushes)
+				}
+				d := seconds(tt.after)
+				if next := u[2].(time.Time); next.Before(before.Add(d)) || next.After(after.Add(d)) {
+					t.Errorf("next push at %v, want %v from now", next.Sub(before), d)
+				}
+			}
+
+			jobs := f.args("INSERT INTO delivery")
+			if tt.method == 0 {
+				if len(jobs) != 0 {
+					t.Errorf("pushed %v, want no push", jobs)
+				}
+				return
+			}
+			if len(jobs) != 1 || jobs[0][1] != int64(tt.method) || jobs[0][3] != JobPending {
+				t.Errorf("pushed %v, want one pending push by method %d", jobs, tt.method)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+/*
+
+expire.go - Expired notif handling for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const reapInterval = time.Minute
+
+// Mark notifs whose expiration time has passed; run every reapInterval.
+// Notifs stored without an expiration have the zero time in expires,
+// which is excluded explicitly.
+func reapExpired(db *sql.DB) {
+	res, err := db.Exec(`UPDATE notification SET expired = true WHERE expired = false AND expires > $1 AND expires <= $2`, time.Time{}, time.Now())
+	if err != nil {
+		fmt.Println("Reaper: Notification update error: ", err)
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		fmt.Println("Reaper: Marked ", n, " notif(s) expired")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/* A database/sql driver standing in for PostgreSQL in tests. A fakeDB
+answers each statement with the result registered for the first
+fragment of SQL text it contains, most recently registered first; a
+result registered with once is used only one time. Queries with no
+matching result return no rows, and other statements succeed with one
+row affected. Every statement is logged with its arguments. */
+
+type fakeResult struct {
+	Rows     [][]driver.Value
+	Affected int64
+	Err      error
+	Once     bool
+}
+
+type fakeRule struct {
+	Fragment string
+	Result   fakeResult
+}
+
+type fakeCall struct {
+	Query string
+	Args  []driver.Value
+}
+
+type fakeDB struct {
+	mu    sync.Mutex
+	rules []fakeRule
+	log   []fakeCall
+}
+
+var fakeDBs = struct {
+	sync.Mutex
+	m map[string]*fakeDB
+	n int
+}{m: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// A new, empty database, closed at the end of the test
+func newFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+	f := &fakeDB{}
+
+	fakeDBs.Lock()
+	fakeDBs.n++
+	name := fmt.Sprintf("db%d", fakeDBs.n)
+	fakeDBs.m[name] = f
+	fakeDBs.Unlock()
+
+	db, err := sql.Open("fakedb", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+// Answer statements containing fragment with rows
+func (f *fakeDB) rows(fragment string, rows ...[]driver.Value) {
+	f.on(fragment, fakeResult{Rows: rows})
+}
+
+// Answer the next statement containing fragment with rows
+func (f *fakeDB) rowsOnce(fragment string, rows ...[]driver.Value) {
+	f.on(fragment, fakeResult{Rows: rows, Once: true})
+}
+
+// Answer statements containing fragment with an error
+func (f *fakeDB) fail(fragment string, err error) {
+	f.on(fragment, fakeResult{Err: err})
+}
+
+func (f *fakeDB) on(fragment string, res fakeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append([]fakeRule{{fragment, res}}, f.rules...)
+}
+
+// Whether a statement containing fragment was run
+func (f *fakeDB) ran(fragment string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.log {
+		if strings.Contains(c.Query, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// The arguments of each statement containing fragment, in order
+func (f *fakeDB) args(fragment string) [][]driver.Value {
+	var args [][]driver.Value
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.log {
+		if strings.Contains(c.Query, fragment) {
+			args = append(args, c.Args)
+		}
+	}
+	return args
+}
+
+func (f *fakeDB) result(query string, args []driver.Value) (fakeResult, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log = append(f.log, fakeCall{query, append([]driver.Value(nil), args...)})
+	for i, r := range f.rules {
+		if strings.Contains(query, r.Fragment) {
+			if r.Result.Once {
+				f.rules = append(f.rules[:i:i], f.rules[i+1:]...)
+			}
+			return r.Result, true
+		}
+	}
+	return fakeResult{}, false
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	f, ok := fakeDBs.m[name]
+	if !ok {
+		return nil, fmt.Errorf("fakedb: no database %s", name)
+	}
+	return fakeConn{f}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	res, ok := s.db.result(s.query, args)
+	if !ok {
+		return driver.RowsAffected(1), nil
+	}
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	if res.Rows != nil {
+		return driver.RowsAffected(len(res.Rows)), nil
+	}
+	return driver.RowsAffected(res.Affected), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	res, _ := s.db.result(s.query, args)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return &fakeRows{rows: res.Rows}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	i    int
+}
+
+func (r *fakeRows) Columns() []string {
+	n := 0
+	if len(r.rows) > 0 {
+		n = len(r.rows[0])
+	}
+	cols := make([]string, n)
+	for i := range cols {
+		cols[i] = fmt.Sprintf("c%d", i)
+	}
+	return cols
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
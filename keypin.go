@@ -0,0 +1,183 @@
+/*
+
+keypin.go - Signing key pinning for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* The first key seen for each authorization and selector is pinned
+(trust on first use), and signatures made under that selector with any
+other key are treated as a possible hijack of the notifier's DNS: they
+are refused, or accepted with an alert to the user, depending on
+configuration. A notifier that starts using another selector has its key
+pinned on first use as well. Pins are kept in the authkey table along
+with the keys installed by administrators, and are told apart by their
+source:
+
+  admin - installed by an administrator; sqlKeySource uses only these
+          keys for the authorization
+  seen  - pinned on first use, or recorded (inactive) when a different
+          key was seen, so the user is alerted once
+
+To rotate a notifier's key, an administrator activates the row recorded
+for the new key, deactivating the old one. */
+
+import (
+	"crypto"
+	"database/sql"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"github.com/pborman/uuid"
+	"time"
+)
+
+// Values of authkey.source
+const (
+	AuthKeyAdmin = "admin"
+	AuthKeySeen  = "seen"
+)
+
+type keyPins struct {
+	Db     *sql.DB
+	Refuse bool                                  // Refuse unpinned keys (otherwise just alert)
+	Alert  func(auth notif.Auth, message string) // Tell the user about a key change
+}
+
+// Check a verified signing key against the keys pinned for an
+// authorization. Returns false if the request should be refused.
+func (kp *keyPins) check(auth notif.Auth, selector string, pub crypto.PublicKey) (bool, error) {
+	var ok, changed bool
+
+	keytype, pubkey, err := encodePublicKey(pub)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+
+	err = inTx(kp.Db, func(tx *sql.Tx) error {
+		// Lock the authorization, so that concurrent first uses
+		// can't pin two different keys
+		_, err := tx.Exec(`SELECT id FROM public.authorization WHERE id = $1 FOR UPDATE`, auth.Id)
+		if err != nil {
+			return err
+		}
+
+		pinned, matched, err := findPin(tx, auth.Id, selector, pubkey)
+		if err != nil {
+			return err
+		}
+
+		if matched {
+			ok = true
+			_, err = tx.Exec(`UPDATE authkey SET last_seen = $1 WHERE auth_id = $2 AND selector = $3 AND pubkey = $4`, now, auth.Id, selector, pubkey)
+			return err
+		}
+
+		if !pinned { //Trust on first use
+			fmt.Println("Pinning ", keytype, " key for authorization ", auth.Id, " selector ", selector)
+			ok = true
+			_, err = tx.Exec(`INSERT INTO authkey (auth_id, selector, keytype, pubkey, active, source, first_seen, last_seen) VALUES ($1, $2, $3, $4, true, $5, $6, $6)`,
+				auth.Id, selector, keytype, pubkey, AuthKeySeen, now)
+			return err
+		}
+
+		// Key changed without an administrator activating it. Record
+		// it, alerting the user only the first time it's seen.
+		ok = !kp.Refuse
+		res, err := tx.Exec(`INSERT INTO authkey (auth_id, selector, keytype, pubkey, active, source, first_seen, last_seen) VALUES ($1, $2, $3, $4, false, $5, $6, $6) ON CONFLICT (auth_id, selector, pubkey) DO NOTHING`,
+			auth.Id, selector, keytype, pubkey, AuthKeySeen, now)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			changed = true
+			return nil
+		}
+		_, err = tx.Exec(`UPDATE authkey SET last_seen = $1 WHERE auth_id = $2 AND selector = $3 AND pubkey = $4`, now, auth.Id, selector, pubkey)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if changed {
+		fmt.Println("Unpinned ", keytype, " key for authorization ", auth.Id, " selector ", selector)
+		if kp.Alert != nil {
+			action := "accepted"
+			if kp.Refuse {
+				action = "refused"
+			}
+			kp.Alert(auth, fmt.Sprintf("Notifs from %s (%s) were signed with a new key (selector %s) and have been %s. If the notifier has not changed its key, its domain may have been hijacked.",
+				auth.Domain, auth.Description, selector, action))
+		}
+	}
+	return ok, nil
+}
+
+// Whether a key is pinned for an authorization's selector, and whether
+// it is pubkey
+func findPin(tx *sql.Tx, authId int, selector string, pubkey string) (pinned bool, matched bool, err error) {
+	var pk string
+
+	err = tx.QueryRow(`SELECT pubkey FROM authkey WHERE auth_id = $1 AND selector = $2 AND active`, authId, selector).Scan(&pk)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, pk == pubkey, nil
+}
+
+// Alert the user to a key change by way of a notif of their own, which
+// is stored and handed to Dispatch for delivery
+func (ag agent) keyAlert(auth notif.Auth, message string) {
+	var nd notif.Notif
+
+	nd.UserID = auth.UserID
+	nd.AuthID = auth.Id
+	nd.To = auth.Address
+	nd.Description = auth.Description
+	nd.From = agentDomain //Not the domain that may have been hijacked
+	nd.Priority = notif.PriPriority
+	nd.Subject = "Signing key changed for " + auth.Domain
+	nd.Body = message
+	nd.NotID = uuid.New()
+	nd.RecvTime = time.Now()
+	nd.Origtime = nd.RecvTime
+	nd.Source = "agent"
+
+	err := insertNotif(ag.Db, nd)
+	if err != nil {
+		fmt.Println("Key alert insert error: ", err)
+		return
+	}
+	if ag.Dispatch != nil {
+		ag.Dispatch(nd)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql/driver"
+	"encoding/base64"
+	"github.com/jimfenton/notif-agent/notif"
+	"testing"
+)
+
+func TestEncodePublicKey(t *testing.T) {
+	rk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _ := testKeyRecord(t)
+
+	for _, pub := range []crypto.PublicKey{&rk.PublicKey, &ek.PublicKey, edPub} {
+		keytype, pubkey, err := encodePublicKey(pub)
+		if err != nil {
+			t.Fatalf("encodePublicKey: %v", err)
+		}
+		der, err := base64.StdEncoding.DecodeString(pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := parsePublicKey(keytype, der)
+		if err != nil {
+			t.Fatalf("parsePublicKey(%s): %v", keytype, err)
+		}
+		if !again.(interface{ Equal(crypto.PublicKey) bool }).Equal(pub) {
+			t.Errorf("%s key changed in encoding", keytype)
+		}
+	}
+}
+
+func TestKeyPins(t *testing.T) {
+	pinnedPub, _ := testKeyRecord(t)
+	newPub, _ := testKeyRecord(t)
+	_, pinned64, err := encodePublicKey(pinnedPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinnedRow := []driver.Value{pinned64}
+
+	tests := []struct {
+		name     string
+		pins     [][]driver.Value
+		seen     bool // Other key already recorded
+		refuse   bool
+		pub      ed25519.PublicKey
+		want     bool
+		pinned   bool // New key pinned
+		recorded bool // New key recorded inactive
+		alerted  bool
+	}{
+		{name: "first use", pub: newPub, refuse: true, want: true, pinned: true},
+		{name: "pinned key", pins: [][]driver.Value{pinnedRow}, pub: pinnedPub, refuse: true, want: true},
+		{name: "changed key refused", pins: [][]driver.Value{pinnedRow}, pub: newPub, refuse: true,
+			want: false, recorded: true, alerted: true},
+		{name: "changed key alerted", pins: [][]driver.Value{pinnedRow}, pub: newPub,
+			want: true, recorded: true, alerted: true},
+		{name: "changed key seen before", pins: [][]driver.Value{pinnedRow}, seen: true, pub: newPub, refuse: true,
+			want: false, recorded: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			f.rows("SELECT pubkey FROM authkey", tt.pins...)
+			if tt.seen {
+				f.on("ON CONFLICT", fakeResult{Affected: 0})
+			}
+			alerts := 0
+			kp := &keyPins{Db: db, Refuse: tt.refuse, Alert: func(auth notif.Auth, message string) { alerts++ }}
+
+			ok, err := kp.check(notif.Auth{Id: 42, Domain: "example.com"}, "sel", tt.pub)
+			if err != nil {
+				t.Fatalf("check: %v", err)
+			}
+			if ok != tt.want {
+				t.Errorf("check = %v, want %v", ok, tt.want)
+			}
+			if !f.ran("FOR UPDATE") {
+				t.Error("authorization not locked")
+			}
+			if q := f.args("SELECT pubkey FROM authkey"); len(q) != 1 || q[0][1] != "sel" {
+				t.Errorf("pin lookups %v, want one for the selector", q)
+			}
+			if f.ran("VALUES ($1, $2, $3, $4, true") != tt.pinned {
+				t.Errorf("key pinned = %v, want %v", !tt.pinned, tt.pinned)
+			}
+			if f.ran("VALUES ($1, $2, $3, $4, false") != tt.recorded {
+				t.Errorf("key recorded = %v, want %v", !tt.recorded, tt.recorded)
+			}
+			if (alerts > 0) != tt.alerted || alerts > 1 {
+				t.Errorf("%d alerts, want alerted = %v", alerts, tt.alerted)
+			}
+		})
+	}
+}
+
+func TestKeyAlert(t *testing.T) {
+	ag, f := newTestAgent(t, nil)
+	var sent []notif.Notif
+	ag.Dispatch = func(n notif.Notif) { sent = append(sent, n) }
+
+	ag.keyAlert(notif.Auth{Id: 42, UserID: 7, Address: testAddr, Domain: "example.com", Description: "Alarm"}, "Key changed")
+
+	if !f.ran("INSERT INTO notification") {
+		t.Error("alert not stored")
+	}
+	if len(sent) != 1 {
+		t.Fatalf("%d alerts dispatched, want 1", len(sent))
+	}
+	if n := sent[0]; n.From != agentDomain || n.Source != "agent" || n.UserID != 7 || n.Body != "Key changed" {
+		t.Errorf("alert = %+v, want one from %q", n, agentDomain)
+	}
+}
@@ -0,0 +1,274 @@
+/*
+
+keyresolver.go - DKIM key lookup and caching for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* Looking up the notifier's key in DNS is the only external dependency
+on the ingest path, so parsed keys are cached. Entries are kept for the
+TTL of the TXT record (within limits) and refreshed in the background
+shortly before they expire, so a busy notifier doesn't see lookup
+latency. Failures are cached too, but only briefly. Concurrent misses
+for the same name share a single lookup. */
+
+import (
+	"crypto"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyMinTTL       = time.Minute
+	keyMaxTTL       = 24 * time.Hour
+	keyNegativeTTL  = 30 * time.Second // Missing or unusable key records
+	keyTempFailTTL  = 5 * time.Second  // DNS timeouts, SERVFAIL, etc.
+	keyRefreshAhead = 0.8              // Fraction of TTL after which a hit triggers a refresh
+	keyCacheMax     = 10000
+	keyDNSTimeout   = 5 * time.Second
+)
+
+type keyEntry struct {
+	key        crypto.PublicKey
+	err        error
+	fetched    time.Time
+	expires    time.Time
+	refreshing bool
+}
+
+// A lookup in progress, which other callers wait for
+type keyCall struct {
+	done chan struct{}
+	e    *keyEntry
+}
+
+type keyResolver struct {
+	sync.Mutex
+	cache   map[string]*keyEntry
+	pending map[string]*keyCall
+
+	// Returns the TXT records (each joined into a single string) at name
+	// and their TTL. Replaceable for testing.
+	lookup func(name string) ([]string, time.Duration, error)
+
+	now func() time.Time // Replaceable for testing
+
+	Stats *expvar.Map // hits, negative_hits, misses, refreshes
+}
+
+func newKeyResolver() *keyResolver {
+	kr := &keyResolver{
+		cache:   make(map[string]*keyEntry),
+		pending: make(map[string]*keyCall),
+		lookup:  lookupTXT,
+		now:     time.Now,
+		Stats:   new(expvar.Map).Init(),
+	}
+	if expvar.Get("keyresolver") == nil {
+		expvar.Publish("keyresolver", kr.Stats)
+	}
+	return kr
+}
+
+// Return the public key published in DNS for selector and the
+// authorization's domain
+func (kr *keyResolver) Key(selector string, auth notif.Auth) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + auth.Domain
+	now := kr.now()
+
+	kr.Lock()
+	e, ok := kr.cache[name]
+	if ok && now.Before(e.expires) {
+		if e.err != nil {
+			kr.Unlock()
+			kr.Stats.Add("negative_hits", 1)
+			return nil, e.err
+		}
+		if !e.refreshing && now.After(e.fetched.Add(time.Duration(float64(e.expires.Sub(e.fetched))*keyRefreshAhead))) {
+			e.refreshing = true
+			go kr.refresh(name)
+		}
+		key := e.key
+		kr.Unlock()
+		kr.Stats.Add("hits", 1)
+		return key, nil
+	}
+	kr.Stats.Add("misses", 1)
+
+	if c, ok := kr.pending[name]; ok {
+		kr.Unlock()
+		<-c.done
+		return c.e.key, c.e.err
+	}
+	c := &keyCall{done: make(chan struct{})}
+	kr.pending[name] = c
+	kr.Unlock()
+
+	c.e = kr.fetch(name)
+	kr.store(name, c.e)
+
+	kr.Lock()
+	delete(kr.pending, name)
+	kr.Unlock()
+	close(c.done)
+	return c.e.key, c.e.err
+}
+
+// Replace a positive entry that is about to expire. If the lookup fails
+// the old entry is kept until it expires.
+func (kr *keyResolver) refresh(name string) {
+	kr.Stats.Add("refreshes", 1)
+	e := kr.fetch(name)
+
+	if e.err != nil {
+		fmt.Println("Key refresh error: ", name, " ", e.err)
+		kr.Lock()
+		if old, ok := kr.cache[name]; ok {
+			old.refreshing = false
+		}
+		kr.Unlock()
+		return
+	}
+	kr.store(name, e)
+}
+
+func (kr *keyResolver) store(name string, e *keyEntry) {
+	kr.Lock()
+	defer kr.Unlock()
+
+	if len(kr.cache) >= keyCacheMax {
+		now := kr.now()
+		for n, old := range kr.cache {
+			if !now.Before(old.expires) {
+				delete(kr.cache, n)
+			}
+		}
+		for n := range kr.cache { // Still full; drop arbitrary entries
+			if len(kr.cache) < keyCacheMax {
+				break
+			}
+			delete(kr.cache, n)
+		}
+	}
+	kr.cache[name] = e
+}
+
+// Look up and parse the key record at name
+func (kr *keyResolver) fetch(name string) *keyEntry {
+	now := kr.now()
+	e := &keyEntry{fetched: now}
+
+	records, ttl, err := kr.lookup(name)
+	if err == nil {
+		e.key, err = decodeKeyRecord(records)
+	}
+	if err != nil {
+		e.err = err
+		if isTemporary(err) {
+			e.expires = now.Add(keyTempFailTTL)
+		} else {
+			e.expires = now.Add(keyNegativeTTL)
+		}
+		return e
+	}
+
+	if ttl < keyMinTTL {
+		ttl = keyMinTTL
+	}
+	if ttl > keyMaxTTL {
+		ttl = keyMaxTTL
+	}
+	e.expires = now.Add(ttl)
+	return e
+}
+
+// Query the system's resolvers for TXT records at name. Unlike
+// net.LookupTXT this reports the TTL of the answer.
+func lookupTXT(name string) ([]string, time.Duration, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, 0, tempError{err}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	c := &dns.Client{Timeout: keyDNSTimeout}
+
+	err = errors.New("no nameservers configured")
+	for _, server := range conf.Servers {
+		addr := net.JoinHostPort(server, conf.Port)
+		r, _, xerr := c.Exchange(m, addr)
+		if xerr == nil && r.Truncated {
+			tc := &dns.Client{Net: "tcp", Timeout: keyDNSTimeout}
+			r, _, xerr = tc.Exchange(m, addr)
+		}
+		if xerr != nil {
+			err = xerr
+			continue
+		}
+
+		switch r.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, 0, errKeyNotFound
+		default:
+			err = fmt.Errorf("%s: %s", name, dns.RcodeToString[r.Rcode])
+			continue
+		}
+
+		records, ttl := txtAnswer(r.Answer)
+		if len(records) == 0 {
+			return nil, 0, errKeyNotFound
+		}
+		return records, ttl, nil
+	}
+	return nil, 0, tempError{err}
+}
+
+// The TXT records in a DNS answer, each joined into a single string, and
+// the lowest TTL among them
+func txtAnswer(answer []dns.RR) ([]string, time.Duration) {
+	var records []string
+	var ttl uint32
+
+	for _, rr := range answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue //CNAME, etc.
+		}
+		// Long records are split into several strings
+		records = append(records, strings.Join(txt.Txt, ""))
+		if ttl == 0 || txt.Hdr.Ttl < ttl {
+			ttl = txt.Hdr.Ttl
+		}
+	}
+	return records, time.Duration(ttl) * time.Second
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/jimfenton/notif-agent/notif"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock for the resolver that only moves when told to
+type testClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// A DNS stand-in serving one answer and counting lookups
+type testDNS struct {
+	sync.Mutex
+	records  []string
+	ttl      time.Duration
+	err      error
+	lookups  int
+	lookedUp chan struct{} // Signalled on each lookup, if set
+	release  chan struct{} // Lookups wait for this, if set
+}
+
+func (d *testDNS) lookup(name string) ([]string, time.Duration, error) {
+	if d.lookedUp != nil {
+		d.lookedUp <- struct{}{}
+	}
+	if d.release != nil {
+		<-d.release
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.lookups++
+	return d.records, d.ttl, d.err
+}
+
+func (d *testDNS) count() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.lookups
+}
+
+func testKeyRecord(t *testing.T) (ed25519.PublicKey, string) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+func newTestResolver(d *testDNS) (*keyResolver, *testClock) {
+	clock := &testClock{t: time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)}
+	kr := newKeyResolver()
+	kr.lookup = d.lookup
+	kr.now = clock.now
+	return kr, clock
+}
+
+var testAuth = notif.Auth{Domain: "example.com"}
+
+func TestKeyResolverTTL(t *testing.T) {
+	pub, rec := testKeyRecord(t)
+	d := &testDNS{records: []string{rec}, ttl: 10 * time.Minute}
+	kr, clock := newTestResolver(d)
+
+	for i := 0; i < 3; i++ {
+		key, err := kr.Key("sel", testAuth)
+		if err != nil {
+			t.Fatalf("Key: %v", err)
+		}
+		if !pub.Equal(key) {
+			t.Fatal("wrong key returned")
+		}
+	}
+	if d.count() != 1 {
+		t.Errorf("%d lookups for cached key, want 1", d.count())
+	}
+
+	// Past the TTL the key is looked up again
+	clock.advance(11 * time.Minute)
+	if _, err := kr.Key("sel", testAuth); err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+	if d.count() != 2 {
+		t.Errorf("%d lookups after expiry, want 2", d.count())
+	}
+}
+
+func TestKeyResolverMinTTL(t *testing.T) {
+	_, rec := testKeyRecord(t)
+	d := &testDNS{records: []string{rec}, ttl: time.Second}
+	kr, clock := newTestResolver(d)
+
+	kr.Key("sel", testAuth)
+	clock.advance(30 * time.Second)
+	kr.Key("sel", testAuth)
+	if d.count() != 1 {
+		t.Errorf("%d lookups within minimum TTL, want 1", d.count())
+	}
+}
+
+func TestKeyResolverNegative(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		ttl  time.Duration
+	}{
+		{"not found", errKeyNotFound, keyNegativeTTL},
+		{"temporary", tempError{errors.New("SERVFAIL")}, keyTempFailTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &testDNS{err: tt.err}
+			kr, clock := newTestResolver(d)
+
+			for i := 0; i < 2; i++ {
+				_, err := kr.Key("sel", testAuth)
+				if err != tt.err {
+					t.Fatalf("Key error %v, want %v", err, tt.err)
+				}
+			}
+			if d.count() != 1 {
+				t.Errorf("%d lookups for cached failure, want 1", d.count())
+			}
+
+			clock.advance(tt.ttl - time.Second)
+			kr.Key("sel", testAuth)
+			if d.count() != 1 {
+				t.Errorf("%d lookups before negative TTL, want 1", d.count())
+			}
+			clock.advance(2 * time.Second)
+			kr.Key("sel", testAuth)
+			if d.count() != 2 {
+				t.Errorf("%d lookups after negative TTL, want 2", d.count())
+			}
+		})
+	}
+}
+
+func TestKeyResolverRefresh(t *testing.T) {
+	_, rec := testKeyRecord(t)
+	d := &testDNS{records: []string{rec}, ttl: 10 * time.Minute}
+	kr, clock := newTestResolver(d)
+
+	kr.Key("sel", testAuth)
+
+	// A hit late in the TTL is answered from the cache and refreshes it
+	// in the background
+	clock.advance(9 * time.Minute)
+	if _, err := kr.Key("sel", testAuth); err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for d.count() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("no refresh lookup")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for { // wait for the refreshed entry to be stored
+		kr.Lock()
+		e := kr.cache["sel._domainkey.example.com"]
+		refreshed := !e.refreshing
+		kr.Unlock()
+		if refreshed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refresh not stored")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Past the original TTL, the refreshed entry is still good
+	clock.advance(5 * time.Minute)
+	kr.Key("sel", testAuth)
+	if d.count() != 2 {
+		t.Errorf("%d lookups after refresh, want 2", d.count())
+	}
+}
+
+func TestKeyResolverSingleLookup(t *testing.T) {
+	_, rec := testKeyRecord(t)
+	d := &testDNS{records: []string{rec}, ttl: 10 * time.Minute,
+		lookedUp: make(chan struct{}, 100), release: make(chan struct{})}
+	kr, _ := newTestResolver(d)
+
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := kr.Key("sel", testAuth)
+			errs <- err
+		}()
+	}
+
+	// Let the callers pile up behind the first lookup
+	<-d.lookedUp
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		kr.Lock()
+		c := kr.pending["sel._domainkey.example.com"]
+		kr.Unlock()
+		if c != nil && kr.Stats.Get("misses").String() == "10" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("callers didn't all miss")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(d.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Key: %v", err)
+		}
+	}
+	if d.count() != 1 {
+		t.Errorf("%d lookups for concurrent misses, want 1", d.count())
+	}
+}
@@ -0,0 +1,256 @@
+/*
+
+keysource.go - Sources of signature keys for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* checkSig gets public keys from a KeySource. Besides DNS (keyResolver),
+keys may be pinned to an authorization in the database or installed as
+files for private notifiers that don't publish keys in DNS. A
+keyChain tries several sources in order. An authorization with keys
+pinned in the database may only use those keys: the other sources
+aren't consulted for it. */
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A KeySource finds the public key for a selector (JWS kid) used by the
+// notifier holding an authorization. It returns an error wrapping
+// errKeyNotFound if it has no such key.
+type KeySource interface {
+	Key(selector string, auth notif.Auth) (crypto.PublicKey, error)
+}
+
+var errKeyNotFound = errors.New("signature key not found")
+
+// The authorization has pinned keys, but not for this selector. Unlike
+// errKeyNotFound, this ends the search of a keyChain.
+var errKeyNotPinned = errors.New("signature key not pinned for authorization")
+
+// Lookup failure that may go away if tried again
+type tempError struct {
+	error
+}
+
+func (tempError) Temporary() bool { return true }
+
+func isTemporary(err error) bool {
+	te, ok := err.(interface{ Temporary() bool })
+	return ok && te.Temporary()
+}
+
+// Try each source in turn, returning the first key found. Any error
+// other than errKeyNotFound ends the search, so that a failing source
+// doesn't hand the decision to a less trusted one.
+type keyChain []KeySource
+
+func (kc keyChain) Key(selector string, auth notif.Auth) (crypto.PublicKey, error) {
+	for _, ks := range kc {
+		key, err := ks.Key(selector, auth)
+		if err == nil {
+			return key, nil
+		}
+		if !errors.Is(err, errKeyNotFound) {
+			return nil, err
+		}
+	}
+	return nil, errKeyNotFound
+}
+
+// Keys installed for an authorization by an administrator in the authkey
+// table. The pubkey column holds the same base64 value as the p= tag of a
+// DKIM key record. Keys pinned on first use (keyPins) are also kept there,
+// but aren't used here, so that a changed key is still found and alerted.
+type sqlKeySource struct {
+	Db *sql.DB
+}
+
+func (sk sqlKeySource) Key(selector string, auth notif.Auth) (crypto.PublicKey, error) {
+	var keytype string
+	var pubkey64 string
+	pinned := false
+	found := false
+
+	rows, err := sk.Db.Query(`SELECT selector, keytype, pubkey FROM authkey WHERE auth_id = $1 AND active AND source = $2`, auth.Id, AuthKeyAdmin)
+	if err != nil {
+		return nil, tempError{err}
+	}
+	for rows.Next() {
+		var sel, kt, pk string
+		err = rows.Scan(&sel, &kt, &pk)
+		if err != nil {
+			rows.Close()
+			return nil, tempError{err}
+		}
+		pinned = true
+		if sel == selector {
+			keytype, pubkey64, found = kt, pk, true
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, tempError{err}
+	}
+
+	switch {
+	case !pinned:
+		return nil, errKeyNotFound
+	case !found:
+		return nil, errKeyNotPinned
+	}
+
+	pubkey, err := base64.StdEncoding.DecodeString(pubkey64)
+	if err != nil {
+		return nil, fmt.Errorf("public key decode error: %v", err)
+	}
+	return parsePublicKey(keytype, pubkey)
+}
+
+// Keys installed as files named <dir>/<domain>/<selector>.pem (a PEM
+// "PUBLIC KEY" block) or <dir>/<domain>/<selector>.jwk (a JSON Web Key)
+type fileKeySource struct {
+	Dir string
+}
+
+func (fk fileKeySource) Key(selector string, auth notif.Auth) (crypto.PublicKey, error) {
+	// Don't let the selector or domain wander out of the key directory
+	if strings.ContainsAny(selector, "/\\") || strings.HasPrefix(selector, ".") ||
+		strings.ContainsAny(auth.Domain, "/\\") || strings.HasPrefix(auth.Domain, ".") {
+		return nil, errKeyNotFound
+	}
+	base := filepath.Join(fk.Dir, auth.Domain, selector)
+
+	data, err := ioutil.ReadFile(base + ".pem")
+	if err == nil {
+		return parsePEMKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	data, err = ioutil.ReadFile(base + ".jwk")
+	if err == nil {
+		return parseJWK(data)
+	}
+	if os.IsNotExist(err) {
+		return nil, errKeyNotFound
+	}
+	return nil, err
+}
+
+func parsePEMKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM public key found")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"` //RSA
+	E   string `json:"e"`
+	X   string `json:"x"` //EC, OKP
+	Y   string `json:"y"` //EC
+}
+
+// Parse an RSA, P-256, or Ed25519 public JSON Web Key (RFC 7517, 8037)
+func parseJWK(data []byte) (crypto.PublicKey, error) {
+	var k jwk
+
+	err := json.Unmarshal(data, &k)
+	if err != nil {
+		return nil, err
+	}
+
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC point not on curve")
+		}
+		return pub, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 public key length")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"github.com/jimfenton/notif-agent/notif"
+	"testing"
+)
+
+// A key source that records whether it was asked
+type askedKeys struct {
+	pub   crypto.PublicKey
+	asked bool
+}
+
+func (k *askedKeys) Key(selector string, auth notif.Auth) (crypto.PublicKey, error) {
+	k.asked = true
+	return k.pub, nil
+}
+
+func TestKeyChainPinned(t *testing.T) {
+	pinnedPub, _ := testKeyRecord(t)
+	dnsPub, _ := testKeyRecord(t)
+	pinnedRow := []driver.Value{"pinned", "ed25519", base64.StdEncoding.EncodeToString(pinnedPub)}
+
+	tests := []struct {
+		name     string
+		rows     [][]driver.Value
+		dberr    error
+		selector string
+		want     crypto.PublicKey
+		wantErr  error
+		asked    bool
+	}{
+		{"no pinned keys", nil, nil, "dns", dnsPub, nil, true},
+		{"pinned selector", [][]driver.Value{pinnedRow}, nil, "pinned", pinnedPub, nil, false},
+		{"unpinned selector", [][]driver.Value{pinnedRow}, nil, "dns", nil, errKeyNotPinned, false},
+		{"database error", nil, errors.New("connection refused"), "dns", nil, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			if tt.dberr != nil {
+				f.fail("FROM authkey", tt.dberr)
+			} else {
+				f.rows("FROM authkey", tt.rows...)
+			}
+			dns := &askedKeys{pub: dnsPub}
+
+			key, err := keyChain{sqlKeySource{db}, dns}.Key(tt.selector, notif.Auth{Id: 42, Domain: "example.com"})
+
+			switch {
+			case tt.dberr != nil:
+				if err == nil || !isTemporary(err) {
+					t.Errorf("error %v, want temporary database error", err)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("error %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("Key: %v", err)
+			case !tt.want.(ed25519.PublicKey).Equal(key):
+				t.Error("wrong key returned")
+			}
+			if dns.asked != tt.asked {
+				t.Errorf("later source asked = %v, want %v", dns.asked, tt.asked)
+			}
+		})
+	}
+}
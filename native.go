@@ -41,20 +41,49 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jimfenton/notif-agent/notif"
 	_ "github.com/lib/pq"
 	"github.com/pborman/uuid"
 	"io/ioutil"
-	"log"
+	"mime"
 	"net/http"
 	"strings"
 	"time"
 )
 
+// Defaults for request size limits and server timeouts, used when
+// agent.cfg doesn't set them
+const (
+	defaultMaxBody      = 64 * 1024 //Request body, bytes
+	defaultMaxSubject   = 256       //Notif subject, bytes
+	defaultMaxNotifBody = 16 * 1024 //Notif body, bytes
+
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// A PUT or DELETE found the notif already deleted
+var errNotifDeleted = errors.New("notif has been deleted")
+
+// How far in the future a notifier's origtime may be before we conclude
+// its clock is wrong
+const maxClockSkew = 5 * time.Minute
+
 type agent struct {
-	Db       *sql.DB
-	CollChan chan notif.Notif
+	Db           *sql.DB
+	CollChan     chan notif.Notif
+	Replay       *replayCache
+	Keys         KeySource
+	Pins         *keyPins
+	Dispatch     func(notif.Notif)
+	RequireNonce bool  //Reject signed requests without jti and iat
+	MaxBody      int64 //Largest request body accepted
+	MaxSubject   int   //Longest notif subject accepted
+	MaxNotifBody int   //Longest notif body accepted
 }
 
 type notifMsg struct { //Notification format "on the wire"
@@ -69,7 +98,10 @@ type notifHeader struct {
 
 type notifProtected struct {
 	Algorithm string `json:"alg"`
-	Selector  string `json:"kid"` //Key ID in JWS terminology
+	Selector  string `json:"kid"`             //Key ID in JWS terminology
+	Nonce     string `json:"jti"`             //Unique per request, for replay protection
+	IssuedAt  int64  `json:"iat"`             //Time signed, seconds since the epoch
+	IdemKey   string `json:"idempotency_key"` //Same for retries of a POST
 }
 
 type notifPayload struct {
@@ -81,24 +113,39 @@ type notifPayload struct {
 	Body     string         `json:"body"` //May become MIME-like JSON
 }
 
+type notifStatus struct { //Response to GET
+	NotID    string    `json:"notid"`
+	RevCount int       `json:"revcount"`
+	RecvTime time.Time `json:"recvtime"` //Time the latest revision was received
+	Read     bool      `json:"read"`
+	Deleted  bool      `json:"deleted"`
+}
+
 // Find an authorization by address
 func findAuth(ag agent, addr string, auth *notif.Auth) error {
-	err := ag.Db.QueryRow(`SELECT id,address,domain,description,created,maxpri,count,active,deleted,user_id FROM public.authorization WHERE address = $1`, addr).Scan(&auth.Id,
+	var latest sql.NullTime
+	var expiration sql.NullTime
+
+	err := ag.Db.QueryRow(`SELECT id,address,domain,description,created,maxpri,latest,count,active,expiration,deleted,user_id FROM public.authorization WHERE address = $1`, addr).Scan(&auth.Id,
 		&auth.Address,
 		&auth.Domain,
 		&auth.Description,
 		&auth.Created,
 		&auth.Maxpri,
+		&latest,
 		&auth.Count,
 		&auth.Active,
+		&expiration,
 		&auth.Deleted,
 		&auth.UserID)
-	return err // TODO: removed Latest, Expiration due to conversion issues from nil
+	auth.Latest = latest.Time         // zero if never used
+	auth.Expiration = expiration.Time // zero if it doesn't expire
+	return err
 }
 
 // Find a notification by ID
-func findNotif(ag agent, notid string, notif *notif.Notif) error {
-	err := ag.Db.QueryRow(`SELECT id,user_id,toaddr,description,origtime,priority,fromdomain,expires,subject,body,notid,recvtime,revcount,read,source,deleted FROM notification WHERE notid = $1`, notid).Scan(&notif.Id,
+func findNotif(db *sql.DB, notid string, notif *notif.Notif) error {
+	err := db.QueryRow(`SELECT id,user_id,toaddr,description,origtime,priority,fromdomain,expires,subject,body,notid,recvtime,revcount,read,source,deleted FROM notification WHERE notid = $1`, notid).Scan(&notif.Id,
 		&notif.UserID,
 		&notif.To,
 		&notif.Description,
@@ -118,6 +165,16 @@ func findNotif(ag agent, notid string, notif *notif.Notif) error {
 	return err
 }
 
+// Find the notID and stored priority of a notif previously POSTed to an
+// authorization with the given idempotency key
+func findIdempotent(db *sql.DB, addr string, key string) (string, notif.NotifPri, error) {
+	var notid string
+	var pri notif.NotifPri
+
+	err := db.QueryRow(`SELECT notid, priority FROM notification WHERE toaddr = $1 AND idempotency_key = $2`, addr, key).Scan(&notid, &pri)
+	return notid, pri, err
+}
+
 // Handle a single native Notif API request
 
 func (ag agent) ServeHTTP(
@@ -134,90 +191,190 @@ func (ag agent) ServeHTTP(
 	var flatload []string //"flattened" payload (header.payload.sig each base64)
 	var protected []byte
 	var err error
-	var addr string //auth (POST) or id (PUT, DELE) from URL
+	var addr string  //auth (POST) or id (GET, PUT, DELETE) from URL
+	var notid string //notID, if the request concerns an existing notif
 
-	if r.Method != "POST" && r.Method != "PUT" && r.Method != "DELE" {
-		w.Header().Add("Allow", "GET, PUT, DELE")
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	if r.Method == "DELE" { //Nonstandard verb used by early notifiers
+		r.Method = "DELETE"
+	}
+
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "PUT" && r.Method != "DELETE" {
+		w.Header().Add("Allow", "GET, POST, PUT, DELETE")
+		writeError(w, CodeMethodNotAllowed, "Method not allowed", "")
 		return
 	}
-	body, err = ioutil.ReadAll(r.Body)
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mt != "application/json" && mt != "application/jose+json") {
+			writeError(w, CodeUnsupportedMedia, "Content type must be application/json", "")
+			return
+		}
+	}
+
+	body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, ag.MaxBody))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Println("Read error: ", err)
+		if _, ok := err.(*http.MaxBytesError); ok {
+			writeError(w, CodeTooLarge, "Request body too large", "")
+			return
+		}
+		writeError(w, CodeReadFailed, "Read error", "")
 		return
 	}
 
-	if r.URL.Path[0:8] == "/notify/" { // Remove leading /notify/ if present
+	if strings.HasPrefix(r.URL.Path, "/notify/") { // Remove leading /notify/ if present
 		addr = r.URL.Path[8:]
 	} else {
-		addr = r.URL.Path[1:]
+		addr = strings.TrimPrefix(r.URL.Path, "/")
+	}
+	if r.Method != "POST" {
+		notid = addr
 	}
 
-	err = json.Unmarshal(body, &nm)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Message unmarshal error")
-		return
+	if r.Method == "GET" && len(body) == 0 {
+		// Clients that can't send a body with GET may pass the
+		// flattened payload as a query parameter instead
+		nm.Payload = r.URL.Query().Get("payload")
+		nm.Header.To = r.URL.Query().Get("to")
+	} else {
+		err = json.Unmarshal(body, &nm)
+		if err != nil {
+			writeError(w, CodeBadMessage, "Message unmarshal error", notid)
+			return
+		}
 	}
 
 	flatload = strings.SplitN(nm.Payload, ".", 3)
+	if len(flatload) != 3 {
+		writeError(w, CodeBadMessage, "Malformed payload", notid)
+		return
+	}
 	payload, err = base64.URLEncoding.DecodeString(pad64(flatload[1]))
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Payload base64 decode error")
+		writeError(w, CodeBadPayload, "Payload base64 decode error", notid)
 		return
 	}
 
 	err = json.Unmarshal(payload, &np)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Payload unmarshal error")
+		writeError(w, CodeBadPayload, "Payload unmarshal error", notid)
 		return
 	}
 
 	protected, err = base64.URLEncoding.DecodeString(pad64(flatload[0]))
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Protected headers base64 decode error")
+		writeError(w, CodeBadProtected, "Protected headers base64 decode error", notid)
 		return
 	}
 
 	err = json.Unmarshal(protected, &npr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Protected headers unmarshal error")
+		writeError(w, CodeBadProtected, "Protected headers unmarshal error", notid)
 		return
 	}
 
-	//TODO: Still need to check to see if expiration is not in the past, etc.
 	//At this point, basic syntax looks good
 
+	if r.Method == "POST" || r.Method == "PUT" {
+		if aerr := ag.checkSizes(np); aerr != nil {
+			fmt.Println(r.Method, ": ", aerr, " ", addr)
+			aerr.write(w, notid)
+			return
+		}
+		if aerr := checkTimes(np, time.Now()); aerr != nil {
+			fmt.Println(r.Method, ": ", aerr, " ", addr)
+			aerr.write(w, notid)
+			return
+		}
+	}
+
 	switch r.Method {
+	case "GET": //Report the status of a notif to the notifier that sent it
+		err = findNotif(ag.Db, addr, &nd)
+		if err != nil {
+			fmt.Println("GET: NotID not found: ", err, " ", addr)
+			writeError(w, CodeNotifNotFound, "Notification ID not found", notid)
+			return
+		}
+
+		// Only the authorization that created the notif can read it, so
+		// the notifier must name it. Other authorizations for the same
+		// domain (and so signing with the same keys) can't tell the
+		// notif exists.
+		if nm.Header.To != nd.To {
+			fmt.Println("GET: Authorization mismatch for ", addr)
+			writeError(w, CodeNotifNotFound, "Notification ID not found", notid)
+			return
+		}
+
+		err = findAuth(ag, nd.To, &auth)
+		if err != nil || auth.Deleted {
+			writeError(w, CodeAuthNotFound, "Authorization not found", notid)
+			return
+		}
+
+		if aerr := checkSig(npr, auth, flatload, ag.Keys, ag.Pins); aerr != nil {
+			aerr.write(w, notid)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, notifStatus{
+			NotID:    nd.NotID,
+			RevCount: nd.RevCount,
+			RecvTime: nd.RecvTime,
+			Read:     nd.Read,
+			Deleted:  nd.Deleted})
+
 	case "POST":
 		err = findAuth(ag, addr, &auth)
 		if err != nil || auth.Deleted {
-			w.WriteHeader(http.StatusNotFound)
 			fmt.Println("Authorization not found: ", addr, " ", err)
-			fmt.Fprint(w, "Authorization not found")
+			writeError(w, CodeAuthNotFound, "Authorization not found", "")
 			return
 		}
 
 		if !auth.Active {
-			w.WriteHeader(http.StatusConflict) // 409 Conflict
-			fmt.Fprint(w, "Inactive authorization")
+			writeError(w, CodeAuthInactive, "Inactive authorization", "")
 			return
 		}
 
-		if checkSig(npr, w, auth, flatload) {
-			//TODO Should there be an error raised here?
+		if auth.Expired(time.Now()) {
+			writeError(w, CodeAuthExpired, "Authorization expired", "")
 			return
 		}
 
-		if auth.Maxpri > np.Priority {
-			fmt.Println("Authorized priority ", auth.Maxpri, " exceeded")
-			np.Priority = auth.Maxpri
-			// Wonder if a different result code should be returned here
+		if aerr := checkSig(npr, auth, flatload, ag.Keys, ag.Pins); aerr != nil {
+			aerr.write(w, "")
+			return
+		}
+
+		// A retry of a POST we've already stored gets the original notID.
+		// This comes before the replay check since the retry may be an
+		// identical request.
+		if npr.IdemKey != "" {
+			orig, pri, err := findIdempotent(ag.Db, addr, npr.IdemKey)
+			if err == nil {
+				fmt.Println("POST: Repeated idempotency key, notid ", orig)
+				w.Header().Set("Location", "/notify/"+orig)
+				writeJSON(w, http.StatusOK, apiResponse{NotID: orig, Priority: pri, Capped: pri != np.Priority})
+				return
+			}
+			if err != sql.ErrNoRows {
+				fmt.Println("POST: Idempotency key lookup error: ", err)
+				writeError(w, CodeInternal, "Idempotency key lookup error", "")
+				return
+			}
+		}
+
+		if aerr := ag.checkReplay(npr, auth); aerr != nil {
+			aerr.write(w, "")
+			return
+		}
+
+		pri, capped, aerr := checkPriority(np.Priority, auth)
+		if aerr != nil {
+			aerr.write(w, "")
+			return
 		}
 
 		nd.UserID = auth.UserID
@@ -227,197 +384,291 @@ func (ag agent) ServeHTTP(
 		nd.Subject = np.Subject
 		nd.From = auth.Domain
 		nd.Description = auth.Description
-		nd.Priority = np.Priority
+		nd.Priority = pri
 		nd.Body = np.Body
 		nd.NotID = uuid.New()
 		nd.RecvTime = time.Now()
+		nd.Source = "native"
+		nd.IdemKey = npr.IdemKey
+		nd.AuthID = auth.Id
 
-		//Update the notification count and time on the authorization
-
-		stmt, err := ag.Db.Prepare("UPDATE public.authorization SET count = count+1, latest = $1 WHERE id = $2")
+		//Store the notif and update the counts on the authorization and userinfo
+		err = storeNotif(ag.Db, nd, auth)
 		if err != nil {
-			fmt.Println("Authorization update error: ", err)
+			// A concurrent retry may have stored it first
+			if nd.IdemKey != "" {
+				if orig, pri, ferr := findIdempotent(ag.Db, addr, nd.IdemKey); ferr == nil {
+					w.Header().Set("Location", "/notify/"+orig)
+					writeJSON(w, http.StatusOK, apiResponse{NotID: orig, Priority: pri, Capped: pri != np.Priority})
+					return
+				}
+			}
+			fmt.Println("POST: Notif store error: ", err)
+			writeError(w, CodeInternal, "Error storing notif", "")
 			return
 		}
 
-		_, err = stmt.Exec(nd.RecvTime, auth.Id)
-		if err != nil {
-			fmt.Println("Authorization update error: ", err)
-			return
-		}
+		//Tell the notifier the notification ID in the response
+		fmt.Println("Response: notid ", nd.NotID)
+		w.Header().Set("Location", "/notify/"+nd.NotID)
+		writeJSON(w, http.StatusCreated, apiResponse{NotID: nd.NotID, Priority: nd.Priority, Capped: capped})
 
-		//Writing the notif itself should probably be common code with other collectors
+		ag.CollChan <- nd
 
-		stmt, err = ag.Db.Prepare(`INSERT INTO notification (user_id,toaddr,description,origtime,priority,fromdomain,expires,subject,body,notid,recvtime,revcount,read,readtime,source,deleted) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)`)
+	case "PUT": //Modify an existing notif by ID
+		err = findNotif(ag.Db, addr, &nd)
 		if err != nil {
-			fmt.Println("Notification insert prepare error: ", err)
+			fmt.Println("PUT: NotID not found: ", err, " ", addr)
+			writeError(w, CodeNotifNotFound, "Notification ID not found", notid)
 			return
 		}
-		_, err = stmt.Exec(nd.UserID, nd.To, nd.Description, nd.Origtime, nd.Priority, nd.From, nd.Expires, nd.Subject, nd.Body, nd.NotID, nd.RecvTime, 0, false, nil, "native", false)
-		if err != nil {
-			fmt.Println("Notification insert error: ", err)
+
+		err = findAuth(ag, nd.To, &auth)
+		if err != nil || auth.Deleted {
+			writeError(w, CodeAuthNotFound, "Authorization not found", notid)
 			return
 		}
 
-		//Update the user's notification count and latest notification time
-
-		stmt, err = ag.Db.Prepare("UPDATE userext SET count = count+1, latest = $1 WHERE user_id = $2")
-		if err != nil {
-			fmt.Println("Userinfo update error: ", err)
+		if !auth.Active {
+			writeError(w, CodeAuthInactive, "Inactive authorization", notid)
 			return
 		}
 
-		_, err = stmt.Exec(nd.RecvTime, auth.UserID)
-		if err != nil {
-			fmt.Println("Userinfo update error: ", err)
+		if auth.Expired(time.Now()) {
+			writeError(w, CodeAuthExpired, "Authorization expired", notid)
 			return
 		}
 
-		//Tell the notifier the notification ID in the response
-		resp := "{ \"notid\": \"" + nd.NotID + "\" }"
-		fmt.Println("Response: ", resp)
-		fmt.Fprint(w, resp)
-
-		ag.CollChan <- nd
-
-		//Read the rules and execute any required push actions
-		//		ProcessRules(ag, nd, auth, uinfo)
-
-	case "PUT": //Modify an existing notif by ID
-		err = findNotif(ag, addr, &nd)
-		if err != nil {
-			fmt.Println("PUT: NotID not found: ", err, " ", addr)
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "PUT: Notification ID not found")
+		if aerr := checkSig(npr, auth, flatload, ag.Keys, ag.Pins); aerr != nil {
+			aerr.write(w, notid)
 			return
 		}
 
-		err = findAuth(ag, nd.To, &auth)
-		if err != nil || auth.Deleted {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "PUT: Authorization not found")
+		if aerr := ag.checkReplay(npr, auth); aerr != nil {
+			aerr.write(w, notid)
 			return
 		}
 
-		if !auth.Active {
-			w.WriteHeader(http.StatusConflict) //409 Conflict
-			fmt.Fprint(w, "Inactive authorization")
+		if nd.Deleted {
+			writeError(w, CodeNotifDeleted, "Notif has been deleted", notid)
 			return
 		}
 
-		if checkSig(npr, w, auth, flatload) {
+		if nd.Origtime.After(np.Origtime) { //time has gone backwards!
+			writeError(w, CodeOutOfOrder, "Update to later notif", notid)
 			return
 		}
 
-		if nd.Origtime.After(np.Origtime) { //time has gone backwards!
-			w.WriteHeader(http.StatusConflict)
-			fmt.Fprint(w, "PUT: Update to later notif")
+		pri, capped, aerr := checkPriority(np.Priority, auth)
+		if aerr != nil {
+			aerr.write(w, notid)
 			return
 		}
 
 		nd.Origtime = np.Origtime
 		nd.Expires = np.Expires
 		nd.Subject = np.Subject
-		nd.Priority = np.Priority
+		nd.Priority = pri
 		nd.Body = np.Body
 		nd.RecvTime = time.Now()
 		nd.RevCount = nd.RevCount + 1
 		nd.Read = false
 		nd.UserID = auth.UserID //should already be there, but just in case
+		nd.AuthID = auth.Id
 
 		auth.Latest = nd.RecvTime
 
-		// Update latest notification time on userinfo
-
-		stmt, err := ag.Db.Prepare("UPDATE userext SET latest = $1 WHERE user_id = $2")
+		err = reviseNotif(ag.Db, nd, auth)
+		if err == errNotifDeleted { //Deleted while we were checking
+			writeError(w, CodeNotifDeleted, "Notif has been deleted", notid)
+			return
+		}
 		if err != nil {
-			fmt.Println("PUT: Userinfo update prepare error: ", err)
+			fmt.Println("PUT: Notif update error: ", err)
+			writeError(w, CodeInternal, "Error updating notif", notid)
 			return
 		}
 
-		_, err = stmt.Exec(nd.RecvTime, auth.UserID)
+		writeJSON(w, http.StatusOK, apiResponse{NotID: nd.NotID, Priority: nd.Priority, Capped: capped})
+
+		ag.CollChan <- nd
+
+	case "DELETE":
+		err = findNotif(ag.Db, addr, &nd)
+
 		if err != nil {
-			fmt.Println("PUT: Userinfo update error: ", err)
+			fmt.Println("DELETE: Notification ID not found: ", err, " ", addr)
+			writeError(w, CodeNotifNotFound, "Notification ID not found", notid)
 			return
 		}
 
-		// Update latest notification time on authorization
-		stmt, err = ag.Db.Prepare("UPDATE public.authorization SET latest = $1 WHERE id = $2")
-		if err != nil {
-			fmt.Println("PUT: Authorization update prepare error: ", err)
+		err = findAuth(ag, nd.To, &auth)
+
+		if err != nil || auth.Deleted {
+			fmt.Println("DELETE: Authorization not found: ", err, " ", nd.To)
+			writeError(w, CodeAuthNotFound, "Authorization not found", notid)
 			return
 		}
 
-		_, err = stmt.Exec(nd.RecvTime, auth.Id)
-		if err != nil {
-			fmt.Println("PUT: Authorization update error: ", err)
+		if aerr := checkSig(npr, auth, flatload, ag.Keys, ag.Pins); aerr != nil {
+			aerr.write(w, notid)
 			return
 		}
 
-		//Read the rules and execute any required push actions
-		//		ProcessRules(ag, nd, auth, uinfo)
+		if aerr := ag.checkReplay(npr, auth); aerr != nil {
+			aerr.write(w, notid)
+			return
+		}
 
-		stmt, err = ag.Db.Prepare("UPDATE notification SET origtime = $1, expires = $2, subject = $3, priority = $4, body = $5, recvtime = $6, revcount=revcount+1, read=false WHERE notid = $7")
-		if err != nil {
-			fmt.Println("PUT: Notif update prepare error: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "PUT: Error updating Notif")
+		if nd.Deleted { //Already retracted
+			writeError(w, CodeNotifDeleted, "Notif has been deleted", notid)
 			return
 		}
 
-		_, err = stmt.Exec(np.Origtime, np.Expires, np.Subject, np.Priority, np.Body, time.Now(), nd.NotID)
+		nd.Deleted = true
+		nd.RecvTime = time.Now()
+		nd.UserID = auth.UserID //should already be there, but just in case
+		err = retractNotif(ag.Db, nd)
+		if err == errNotifDeleted { //Deleted by a concurrent request
+			writeError(w, CodeNotifDeleted, "Notif has been deleted", notid)
+			return
+		}
 		if err != nil {
-			fmt.Println("PUT: Notif update error: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "PUT: Error updating Notif")
+			fmt.Println("DELETE: Notif update error: ", err)
+			writeError(w, CodeInternal, "Error deleting notif", notid)
 			return
 		}
 
+		writeJSON(w, http.StatusOK, apiResponse{NotID: nd.NotID})
+
 		ag.CollChan <- nd
 
-	case "DELE":
-		err = findNotif(ag, addr, &nd)
+	} //method switch
+}
+
+// Run f in a transaction, committing if it succeeds and rolling back if not
+func inTx(db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
 
+// Store a new notif, and count it on its authorization and user
+func storeNotif(db *sql.DB, nd notif.Notif, auth notif.Auth) error {
+	return inTx(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE public.authorization SET count = count+1, latest = $1 WHERE id = $2", nd.RecvTime, auth.Id)
 		if err != nil {
-			fmt.Println("DELE: Notification ID not found: ", err, " ", addr)
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "DELE: Notification ID not found")
-			return
+			return fmt.Errorf("authorization update: %v", err)
 		}
 
-		err = findAuth(ag, nd.To, &auth)
+		err = insertNotif(tx, nd)
+		if err != nil {
+			return fmt.Errorf("notification insert: %v", err)
+		}
 
+		_, err = tx.Exec("UPDATE userext SET count = count+1, latest = $1 WHERE user_id = $2", nd.RecvTime, auth.UserID)
 		if err != nil {
-			fmt.Println("DELE: Authorization not found: ", err, " ", nd.To)
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "DELE: Authorization not found")
-			return
+			return fmt.Errorf("userinfo update: %v", err)
 		}
+		return nil
+	})
+}
 
-		if checkSig(npr, w, auth, flatload) {
-			return
+// Store a revision of a notif, and update the latest notification time
+// on its authorization and user
+func reviseNotif(db *sql.DB, nd notif.Notif, auth notif.Auth) error {
+	return inTx(db, func(tx *sql.Tx) error {
+		// The notif may have been deleted since it was read; don't revive it
+		res, err := tx.Exec("UPDATE notification SET origtime = $1, expires = $2, subject = $3, priority = $4, body = $5, recvtime = $6, revcount=revcount+1, read=false, expired=false WHERE notid = $7 AND deleted = false",
+			nd.Origtime, nd.Expires, nd.Subject, nd.Priority, nd.Body, nd.RecvTime, nd.NotID)
+		if err != nil {
+			return fmt.Errorf("notification update: %v", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("notification update: %v", err)
+		}
+		if n == 0 {
+			return errNotifDeleted
 		}
 
-		nd.Deleted = true
-		nd.RecvTime = time.Now()
-		nd.UserID = auth.UserID //should already be there, but just in case
-		stmt, err := ag.Db.Prepare("UPDATE notification SET recvtime = $1, deleted=true WHERE notid = $7")
+		_, err = tx.Exec("UPDATE userext SET latest = $1 WHERE user_id = $2", nd.RecvTime, auth.UserID)
 		if err != nil {
-			fmt.Println("DELE: Notif update prepare error: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "DELE: Notif update prepare error")
-			return
+			return fmt.Errorf("userinfo update: %v", err)
 		}
 
-		_, err = stmt.Exec(time.Now(), nd.NotID)
+		_, err = tx.Exec("UPDATE public.authorization SET latest = $1 WHERE id = $2", nd.RecvTime, auth.Id)
 		if err != nil {
-			fmt.Println("DELE: Notif update error: ", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "DELE: Notif update error")
-			return
+			return fmt.Errorf("authorization update: %v", err)
 		}
+		return nil
+	})
+}
 
-	} //method switch
+// Mark a notif deleted, unless it already is
+func retractNotif(db *sql.DB, nd notif.Notif) error {
+	res, err := db.Exec("UPDATE notification SET recvtime = $1, deleted=true WHERE notid = $2 AND deleted = false", nd.RecvTime, nd.NotID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotifDeleted
+	}
+	return nil
+}
+
+// Sanity check the origination and expiration times of a new or updated
+// notif. A zero Expires means the notif doesn't expire.
+func checkTimes(np notifPayload, now time.Time) *apiError {
+	if !np.Expires.IsZero() {
+		if np.Expires.Before(np.Origtime) {
+			return &apiError{CodeExpiresBeforeOrig, "Expiration before origination time"}
+		}
+		if !now.Before(np.Expires) {
+			return &apiError{CodeAlreadyExpired, "Notif already expired"}
+		}
+	}
+	if np.Origtime.After(now.Add(maxClockSkew)) {
+		return &apiError{CodeOrigtimeInFuture, "Origination time in the future"}
+	}
+	return nil
+}
+
+// Apply an authorization's priority limit to the priority requested by
+// the notifier. Lower values are more urgent, so a request more urgent
+// than auth.Maxpri is lowered to it (and capped is true); a Maxpri of
+// zero means no limit.
+func checkPriority(requested notif.NotifPri, auth notif.Auth) (pri notif.NotifPri, capped bool, aerr *apiError) {
+	if requested < notif.PriEmergency || requested > notif.PriInformational {
+		return 0, false, &apiError{CodeBadPriority, fmt.Sprintf("Priority %d out of range", requested)}
+	}
+	if auth.Maxpri != 0 && requested < auth.Maxpri {
+		fmt.Println("Authorized priority ", auth.Maxpri, " exceeded")
+		return auth.Maxpri, true, nil
+	}
+	return requested, false, nil
+}
+
+// Check the lengths of the variable-length fields of a notif
+func (ag agent) checkSizes(np notifPayload) *apiError {
+	if len(np.Subject) > ag.MaxSubject {
+		return &apiError{CodeTooLarge, fmt.Sprintf("Subject longer than %d bytes", ag.MaxSubject)}
+	}
+	if len(np.Body) > ag.MaxNotifBody {
+		return &apiError{CodeTooLarge, fmt.Sprintf("Body longer than %d bytes", ag.MaxNotifBody)}
+	}
+	return nil
 }
 
 func pad64(input string) string {
@@ -434,10 +685,52 @@ func pad64(input string) string {
 	}
 }
 
-func collectNative(db *sql.DB, c chan notif.Notif) {
+// Set up the native notif API server; the caller starts and stops it.
+// Handlers send received notifs on c until Shutdown returns, and pass
+// notifs the agent creates (key change alerts) to dispatch.
+func newNativeServer(db *sql.DB, c chan notif.Notif, dispatch func(notif.Notif), cfg AgentDbCfg) *http.Server {
 	var ag agent //Probably doesn't belong in Notif package
 	ag.Db = db
 	ag.CollChan = c
+	ag.Dispatch = dispatch
+	ag.Replay = newReplayCache(replayCacheSize, 2*replayWindow)
+
+	// Keys pinned in the database take precedence over files, which
+	// take precedence over DNS
+	keys := keyChain{sqlKeySource{db}}
+	if cfg.KeyDir != "" {
+		keys = append(keys, fileKeySource{cfg.KeyDir})
+	}
+	ag.Keys = append(keys, newKeyResolver())
+	ag.Pins = &keyPins{Db: db, Refuse: cfg.KeyChange != "alert", Alert: ag.keyAlert}
+	ag.RequireNonce = cfg.RequireNonce
+	ag.MaxBody = int64(orDefault(cfg.MaxBody, defaultMaxBody))
+	ag.MaxSubject = orDefault(cfg.MaxSubject, defaultMaxSubject)
+	ag.MaxNotifBody = orDefault(cfg.MaxNotifBody, defaultMaxNotifBody)
+
+	// Timeouts keep slow or idle clients from holding connections open
+	return &http.Server{
+		Addr:              ":5342",
+		Handler:           ag,
+		ReadHeaderTimeout: secondsOr(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       secondsOr(cfg.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      secondsOr(cfg.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       secondsOr(cfg.IdleTimeout, defaultIdleTimeout),
+	}
+}
 
-	log.Fatal(http.ListenAndServe(":5342", ag))
+// Configured value if set, otherwise the default
+func orDefault(v int, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// Configured number of seconds if set, otherwise the default
+func secondsOr(secs int, def time.Duration) time.Duration {
+	if secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return def
 }
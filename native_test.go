@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/jimfenton/notif-agent/notif"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testAddr  = "a1b2c3d4e5f6"
+	testNotID = "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+)
+
+// Public keys handed out regardless of selector
+type testKeys struct {
+	pub crypto.PublicKey
+	err error
+}
+
+func (k testKeys) Key(selector string, auth notif.Auth) (crypto.PublicKey, error) {
+	return k.pub, k.err
+}
+
+// A notifier with its own Ed25519 signing key
+type testNotifier struct {
+	pub  ed25519.PublicKey
+	priv ed25519.PrivateKey
+}
+
+func newTestNotifier(t *testing.T) testNotifier {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testNotifier{pub, priv}
+}
+
+// Sign a payload as a wire-format message
+func (n testNotifier) message(t *testing.T, to string, p notifPayload) []byte {
+	return n.messageWith(t, to, notifProtected{}, p)
+}
+
+// Sign a payload with extra protected headers
+func (n testNotifier) messageWith(t *testing.T, to string, npr notifProtected, p notifPayload) []byte {
+	npr.Algorithm = "EdDSA"
+	npr.Selector = "test"
+	prot, err := json.Marshal(npr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(prot) + "." + enc.EncodeToString(pay)
+	sig := ed25519.Sign(n.priv, []byte(input))
+
+	body, err := json.Marshal(notifMsg{Header: notifHeader{To: to}, Payload: input + "." + enc.EncodeToString(sig)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func testPayload() notifPayload {
+	now := time.Now()
+	return notifPayload{
+		Origtime: now,
+		Expires:  now.Add(time.Hour),
+		Priority: notif.PriRoutine,
+		Subject:  "Door open",
+		Body:     "The garage door is open."}
+}
+
+func newTestAgent(t *testing.T, keys KeySource) (agent, *fakeDB) {
+	db, f := newFakeDB(t)
+	return agent{
+		Db:           db,
+		CollChan:     make(chan notif.Notif, 10),
+		Replay:       newReplayCache(replayCacheSize, 2*replayWindow),
+		Keys:         keys,
+		MaxBody:      defaultMaxBody,
+		MaxSubject:   defaultMaxSubject,
+		MaxNotifBody: defaultMaxNotifBody,
+	}, f
+}
+
+// A row of public.authorization as selected by findAuth
+func authRow(active bool, expiration interface{}, deleted bool) []driver.Value {
+	return []driver.Value{int64(42), testAddr, "example.com", "Alarm", time.Now().Add(-24 * time.Hour),
+		int64(notif.PriPriority), nil, int64(3), active, expiration, deleted, int64(7)}
+}
+
+// A row of notification as selected by findNotif
+func notifRow(origtime time.Time, deleted bool) []driver.Value {
+	return []driver.Value{int64(9), int64(7), testAddr, "Alarm", origtime, int64(notif.PriRoutine), "example.com",
+		origtime.Add(time.Hour), "Door open", "The garage door is open.", testNotID, origtime, int64(0), false, "native", deleted}
+}
+
+// Serve a request and decode the response body
+func serve(ag agent, method string, path string, body []byte) (*httptest.ResponseRecorder, apiResponse) {
+	var resp apiResponse
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ag.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func TestFindAuthNullTimes(t *testing.T) {
+	ag, f := newTestAgent(t, nil)
+	f.rows("FROM public.authorization", authRow(true, nil, false))
+
+	var auth notif.Auth
+	if err := findAuth(ag, testAddr, &auth); err != nil {
+		t.Fatalf("findAuth: %v", err)
+	}
+	if !auth.Latest.IsZero() || !auth.Expiration.IsZero() {
+		t.Errorf("latest %v, expiration %v; want zero times", auth.Latest, auth.Expiration)
+	}
+	if auth.Expired(time.Now()) {
+		t.Error("authorization without expiration has expired")
+	}
+	if auth.Id != 42 || auth.Domain != "example.com" || auth.Maxpri != notif.PriPriority || auth.UserID != 7 {
+		t.Errorf("authorization = %+v", auth)
+	}
+}
+
+func TestFindAuthTimes(t *testing.T) {
+	ag, f := newTestAgent(t, nil)
+	latest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	expiration := time.Now().Add(-time.Minute).Truncate(time.Second)
+	row := authRow(true, expiration, false)
+	row[6] = latest
+	f.rows("FROM public.authorization", row)
+
+	var auth notif.Auth
+	if err := findAuth(ag, testAddr, &auth); err != nil {
+		t.Fatalf("findAuth: %v", err)
+	}
+	if !auth.Latest.Equal(latest) || !auth.Expiration.Equal(expiration) {
+		t.Errorf("latest %v, expiration %v; want %v, %v", auth.Latest, auth.Expiration, latest, expiration)
+	}
+	if !auth.Expired(time.Now()) {
+		t.Error("authorization past its expiration hasn't expired")
+	}
+}
+
+func TestExpiredAuthorization(t *testing.T) {
+	n := newTestNotifier(t)
+	expired := time.Now().Add(-time.Minute)
+
+	for _, method := range []string{"POST", "PUT"} {
+		t.Run(method, func(t *testing.T) {
+			ag, f := newTestAgent(t, testKeys{pub: n.pub})
+			f.rows("FROM public.authorization", authRow(true, expired, false))
+			f.rows("FROM notification WHERE notid", notifRow(time.Now().Add(-time.Hour), false))
+
+			path := "/notify/" + testAddr
+			if method == "PUT" {
+				path = "/notify/" + testNotID
+			}
+			w, resp := serve(ag, method, path, n.message(t, testAddr, testPayload()))
+
+			if w.Code != http.StatusForbidden || resp.Error != CodeAuthExpired {
+				t.Errorf("got %d %q, want 403 %q", w.Code, resp.Error, CodeAuthExpired)
+			}
+			if f.ran("INSERT INTO notification") || f.ran("UPDATE notification") {
+				t.Error("notif stored under an expired authorization")
+			}
+			if len(ag.CollChan) != 0 {
+				t.Error("notif collected under an expired authorization")
+			}
+		})
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	n := newTestNotifier(t)
+	other := newTestNotifier(t)
+	notifPath := "/notify/" + testNotID
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		ctype  string
+		body   []byte
+		keys   testKeys
+		setup  func(f *fakeDB)
+		status int
+		code   string
+		notid  string
+	}{
+		{name: "created", method: "POST", status: http.StatusCreated},
+		{name: "method", method: "PATCH", status: http.StatusMethodNotAllowed, code: CodeMethodNotAllowed},
+		{name: "content type", method: "POST", ctype: "text/plain", status: http.StatusUnsupportedMediaType, code: CodeUnsupportedMedia},
+		{name: "too large", method: "POST", body: bytes.Repeat([]byte(" "), defaultMaxBody+1),
+			status: http.StatusRequestEntityTooLarge, code: CodeTooLarge},
+		{name: "not JSON", method: "POST", body: []byte("notif"), status: http.StatusBadRequest, code: CodeBadMessage},
+		{name: "no payload", method: "POST", body: []byte(`{"header":{"to":"` + testAddr + `"}}`),
+			status: http.StatusBadRequest, code: CodeBadMessage},
+		{name: "key not found", method: "POST", keys: testKeys{err: errKeyNotFound},
+			status: http.StatusUnauthorized, code: CodeKeyNotFound},
+		{name: "wrong key", method: "POST", keys: testKeys{pub: other.pub},
+			status: http.StatusUnauthorized, code: CodeSignatureInvalid},
+		{name: "inactive", method: "POST", setup: func(f *fakeDB) {
+			f.rows("FROM public.authorization", authRow(false, nil, false))
+		}, status: http.StatusForbidden, code: CodeAuthInactive},
+		{name: "no authorization", method: "POST", setup: func(f *fakeDB) {
+			f.rows("FROM public.authorization")
+		}, status: http.StatusNotFound, code: CodeAuthNotFound},
+		{name: "no notif", method: "PUT", path: notifPath, setup: func(f *fakeDB) {
+			f.rows("FROM notification WHERE notid")
+		}, status: http.StatusNotFound, code: CodeNotifNotFound, notid: testNotID},
+		{name: "deleted notif", method: "PUT", path: notifPath, setup: func(f *fakeDB) {
+			f.rows("FROM notification WHERE notid", notifRow(time.Now().Add(-time.Hour), true))
+		}, status: http.StatusConflict, code: CodeNotifDeleted, notid: testNotID},
+		{name: "deleted during update", method: "PUT", path: notifPath, setup: func(f *fakeDB) {
+			f.on("UPDATE notification SET origtime", fakeResult{Affected: 0})
+		}, status: http.StatusConflict, code: CodeNotifDeleted, notid: testNotID},
+		{name: "deleted", method: "DELETE", path: notifPath, status: http.StatusOK, notid: testNotID},
+		{name: "deleted again", method: "DELETE", path: notifPath, setup: func(f *fakeDB) {
+			f.rows("FROM notification WHERE notid", notifRow(time.Now().Add(-time.Hour), true))
+		}, status: http.StatusConflict, code: CodeNotifDeleted, notid: testNotID},
+		{name: "deleted concurrently", method: "DELETE", path: notifPath, setup: func(f *fakeDB) {
+			f.on("SET recvtime = $1, deleted=true", fakeResult{Affected: 0})
+		}, status: http.StatusConflict, code: CodeNotifDeleted, notid: testNotID},
+		{name: "key lookup failure", method: "POST", keys: testKeys{err: tempError{errKeyNotFound}},
+			status: http.StatusServiceUnavailable, code: CodeKeyLookupFailed},
+		{name: "store failure", method: "POST", setup: func(f *fakeDB) {
+			f.fail("INSERT INTO notification", driver.ErrBadConn)
+		}, status: http.StatusInternalServerError, code: CodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := tt.keys
+			if keys.pub == nil && keys.err == nil {
+				keys.pub = n.pub
+			}
+			ag, f := newTestAgent(t, keys)
+			f.rows("FROM public.authorization", authRow(true, nil, false))
+			f.rows("FROM notification WHERE notid", notifRow(time.Now().Add(-time.Hour), false))
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+
+			path, body, ctype := tt.path, tt.body, tt.ctype
+			if path == "" {
+				path = "/notify/" + testAddr
+			}
+			if body == nil {
+				body = n.message(t, testAddr, testPayload())
+			}
+			if ctype == "" {
+				ctype = "application/json"
+			}
+			req := httptest.NewRequest(tt.method, path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", ctype)
+			w := httptest.NewRecorder()
+			ag.ServeHTTP(w, req)
+
+			var resp apiResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response %q: %v", w.Body.String(), err)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type %q", ct)
+			}
+			if w.Code != tt.status || resp.Error != tt.code {
+				t.Errorf("got %d %q, want %d %q", w.Code, resp.Error, tt.status, tt.code)
+			}
+			if tt.code != "" {
+				if resp.Message == "" {
+					t.Error("error without message")
+				}
+				if resp.NotID != tt.notid {
+					t.Errorf("notid %q, want %q", resp.NotID, tt.notid)
+				}
+				if len(ag.CollChan) != 0 {
+					t.Error("failed request collected")
+				}
+			} else if len(ag.CollChan) != 1 {
+				t.Error("request not collected")
+			}
+		})
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	n := newTestNotifier(t)
+
+	tests := []struct {
+		name      string
+		requested notif.NotifPri
+		stored    notif.NotifPri
+		capped    bool
+	}{
+		{"as requested", notif.PriRoutine, notif.PriRoutine, false},
+		{"capped", notif.PriEmergency, notif.PriPriority, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ag, f := newTestAgent(t, testKeys{pub: n.pub})
+			f.rows("FROM public.authorization", authRow(true, nil, false))
+			f.rows("AND idempotency_key", []driver.Value{testNotID, int64(tt.stored)})
+
+			p := testPayload()
+			p.Priority = tt.requested
+			body := n.messageWith(t, testAddr, notifProtected{IdemKey: "retry-1"}, p)
+			w, resp := serve(ag, "POST", "/notify/"+testAddr, body)
+
+			if w.Code != http.StatusOK || resp.NotID != testNotID {
+				t.Fatalf("got %d %q, want 200 %q", w.Code, resp.NotID, testNotID)
+			}
+			if resp.Priority != tt.stored || resp.Capped != tt.capped {
+				t.Errorf("priority %d capped %v, want %d %v", resp.Priority, resp.Capped, tt.stored, tt.capped)
+			}
+			if f.ran("INSERT INTO notification") || len(ag.CollChan) != 0 {
+				t.Error("retry stored as a new notif")
+			}
+		})
+	}
+}
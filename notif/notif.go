@@ -39,6 +39,20 @@ const (
 	PriInformational
 )
 
+func (p NotifPri) String() string {
+	switch p {
+	case PriEmergency:
+		return "Emergency"
+	case PriPriority:
+		return "Priority"
+	case PriRoutine:
+		return "Routine"
+	case PriInformational:
+		return "Informational"
+	}
+	return "Unknown"
+}
+
 // Representations of various data structures in PostgreSQL
 
 type Notif struct { //Notification document in MongoDB database
@@ -58,7 +72,14 @@ type Notif struct { //Notification document in MongoDB database
 	ReadTime    time.Time //Database: "readtime"
 	Deleted     bool      //Database: "deleted"
 	Source      string
-	UserID      int //Database: "user_id"
+	UserID      int    //Database: "user_id"
+	IdemKey     string //Database: "idempotency_key" (NULL if none)
+	AuthID      int    //Authorization received under; not stored
+}
+
+// Whether the notif has expired as of now. A zero Expires never expires.
+func (n Notif) Expired(now time.Time) bool {
+	return !n.Expires.IsZero() && !now.Before(n.Expires)
 }
 
 type Auth struct {
@@ -76,6 +97,12 @@ type Auth struct {
 	Deleted     bool      //Database: "deleted"
 }
 
+// Whether the authorization has expired as of now. A zero Expiration
+// never expires.
+func (a Auth) Expired(now time.Time) bool {
+	return !a.Expiration.IsZero() && !now.Before(a.Expiration)
+}
+
 // Per-user settings and information
 type Userinfo struct {
 	Id                  int       //Database: "_id"
@@ -85,6 +112,7 @@ type Userinfo struct {
 	EmailServer         string    //Database: "email_server"
 	EmailPort           int       //Database: "email_port"
 	EmailFrom           string    //Database: "email_from"
+	EmailPassword       string    //Database: "email_password"
 	EmailSecurity       int       //Database: "email_security"
 	EmailAuthentication int       //Database: "email_authentication"
 	Created             time.Time //Database: "created"
@@ -92,15 +120,40 @@ type Userinfo struct {
 	TwilioSID           string    //Database: "twilio_sid"  (Overrides site setting if present)
 	TwilioToken         string    //Database: "twilio_token"
 	TwilioFrom          string    //Database: "twilio_from"
+	TimeZone            string    //Database: "time_zone" (IANA name, e.g. "America/Los_Angeles")
+	QuietPriority       bool      //Database: "quiet_priority" (hold PriPriority notifs in quiet hours too)
+	Quiet               []QuietWindow
+	DigestSchedule      string //Database: "digest_schedule" ("hourly" or "daily")
+	DigestHour          int    //Database: "digest_hour" (for daily digests)
+}
+
+// A weekly period during which the user doesn't want to be called or
+// texted, in the user's time zone
+type QuietWindow struct {
+	Id        int //Database: "id"
+	UserID    int //Database: "user_id"
+	Days      int //Database: "days" (weekday bitmask, Sunday = 1; 0 for every day)
+	StartHour int //Database: "start_hour"
+	EndHour   int //Database: "end_hour"
 }
 
 type Rule struct {
-	Id       int      //Database: "_id"
-	UserID   int      //Database: "user_id"
-	Domain   string   //Database: "domain"
-	Priority NotifPri //Database: "priority"
-	Active   bool     //Database: "active"
-	Method   int      //Database: "method_id"
+	Id           int      //Database: "_id"
+	UserID       int      //Database: "user_id"
+	Domain       string   //Database: "domain" (pattern)
+	Priority     NotifPri //Database: "priority" (exact)
+	MinPriority  NotifPri //Database: "min_priority" (this urgent or more)
+	AuthID       int      //Database: "auth_id" (NULL for any)
+	Subject      string   //Database: "subject"
+	SubjectRegex bool     //Database: "subject_regex"
+	Days         int      //Database: "days" (weekday bitmask, Sunday = 1)
+	StartHour    int      //Database: "start_hour"
+	EndHour      int      //Database: "end_hour"
+	Seq          int      //Database: "seq"
+	Stop         bool     //Database: "stop"
+	Active       bool     //Database: "active"
+	Method       int      //Database: "method_id"
+	EscalationID int      //Database: "escalation_id" (NULL for none)
 }
 
 // Global settings for the site
@@ -27,14 +27,13 @@ SOFTWARE.
 package main
 
 import (
-	"bitbucket.org/ckvist/twilio/twirest"
 	"database/sql"
 	"fmt"
 	"github.com/jimfenton/notif-agent/notif"
 	_ "github.com/lib/pq"
-	"net/url"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type Method struct {
@@ -45,111 +44,119 @@ type Method struct {
 	Mode     int    //`bson:"type"` //TODO: Change field name to "mode"
 	Address  string //`bson:"address"`
 	Preamble string //`bson:"preamble"`
+	Secret   string //Database: "secret" (webhook HMAC key)
+	Target   int    //Database: "target_id" (digest: method the digest is sent by)
 }
 
 const (
 	ModeEmail = iota
 	ModeText
 	ModeVoice
+	ModeWebhook
+	ModeDigest
 )
 
-func ProcessRules(n notif.Notif, db *sql.DB, user notif.Userinfo, site notif.Siteinfo) {
+// Find a method by ID
+func findMethod(db *sql.DB, id int, m *Method) error {
+	var secret sql.NullString
+	var target sql.NullInt64
+
+	err := db.QueryRow(`SELECT id, user_id, active, name, type, address, preamble, secret, target_id FROM method WHERE id = $1`, id).Scan(&m.Id, &m.User, &m.Active, &m.Name, &m.Mode, &m.Address, &m.Preamble, &secret, &target)
+	m.Secret = secret.String
+	m.Target = int(target.Int64)
+	return err
+}
+
+// Match a notif against the user's rules, in order, and queue a delivery
+// for each selected method. Urgent notifs matching a rule with an
+// escalation policy start an escalation instead.
+func ProcessRules(n notif.Notif, db *sql.DB, user notif.Userinfo, q *deliveryQueue, esc *escalator) {
 	var m Method
 	var r notif.Rule
-	var u []int
-	rules, err := db.Query(`SELECT active, priority, domain, method_id FROM rule WHERE user_id = $1`, n.UserID)
+	var u []int // methods used
+	var e []int // escalations started
+	var authID sql.NullInt64
+	var escalationID sql.NullInt64
+
+	loc := userLocation(user)
+	now := time.Now()
+
+	rules, err := db.Query(`SELECT id, active, priority, min_priority, domain, auth_id, subject, subject_regex, days, start_hour, end_hour, seq, stop, method_id, escalation_id FROM rule WHERE user_id = $1 ORDER BY seq, id`, n.UserID)
 	if err != nil {
 		fmt.Println("Push: Ruleset query error: ", err, " user ", n.UserID)
 		return
 	}
+	defer rules.Close()
 
-ruleloop:
 	for rules.Next() {
-		err = rules.Scan(&r.Active, &r.Priority, &r.Domain, &r.Method)
+		err = rules.Scan(&r.Id, &r.Active, &r.Priority, &r.MinPriority, &r.Domain, &authID, &r.Subject, &r.SubjectRegex,
+			&r.Days, &r.StartHour, &r.EndHour, &r.Seq, &r.Stop, &r.Method, &escalationID)
 		if err != nil {
 			fmt.Println("Push: Rule scan error: ", err)
 			continue
 		}
+		r.AuthID = int(authID.Int64)
+		r.EscalationID = int(escalationID.Int64)
 
-		if r.Active &&
-			(r.Domain == "" || r.Domain == n.From) &&
-			(r.Priority == 0 || r.Priority == n.Priority) {
+		if !ruleMatches(r, n, loc, now) {
+			continue
+		}
 
-			// check to make sure each method only executed once per notif
-			for _, mu := range u {
-				if mu == r.Method {
-					continue ruleloop
-				} // if mu
-			} // for mu
+		// check to make sure each method and escalation only executed
+		// once per notif
+		if r.EscalationID != 0 && escalates(n) {
+			if !containsInt(e, r.EscalationID) {
+				e = append(e, r.EscalationID)
+				err = esc.start(n, r.EscalationID)
+				if err != nil {
+					fmt.Println("Push: Escalation start error: ", err, " escalation ", r.EscalationID)
+				}
+			}
+		} else if !containsInt(u, r.Method) {
 			u = append(u, r.Method)
-			err = db.QueryRow(`SELECT id, user_id, active, name, type, address, preamble FROM method WHERE id = $1`, r.Method).Scan(&m.Id, &m.User, &m.Active, &m.Name, &m.Mode, &m.Address, &m.Preamble)
+			err = findMethod(db, r.Method, &m)
 			if err != nil {
 				fmt.Println("Push: Method query error: ", err)
-				continue
+			} else if m.Mode == ModeDigest {
+				err = collectDigest(db, q, user, m, n, now)
+				if err != nil {
+					fmt.Println("Push: Digest error: ", err, " method ", m.Id)
+				}
+			} else if quietHold(user, m, n, now) {
+				err = q.hold(n, m)
+				if err != nil {
+					fmt.Println("Push: Delivery hold error: ", err, " method ", m.Id)
+				}
+			} else {
+				err = q.enqueue(n, m)
+				if err != nil {
+					fmt.Println("Push: Delivery queue error: ", err, " method ", m.Id)
+				}
 			}
-			doMethod(m, n, user, site)
-		} //if r.Active...
-
-	} // for rules.Next (ruleloop)
-}
-
-func doMethod(m Method, n notif.Notif, user notif.Userinfo, site notif.Siteinfo) {
-	twilioSID := site.TwilioSID
-	twilioToken := site.TwilioToken
-	twilioFrom := site.TwilioFrom
-
-	if user.TwilioSID != "" {
-		twilioSID = user.TwilioSID
-		twilioToken = user.TwilioToken
-		twilioFrom = user.TwilioFrom
-	}
-
-	switch m.Mode {
-	case ModeText:
-		if m.Address == "" {
-			fmt.Println("Can't send text: method address empty")
-			return
-		}
-		if twilioFrom == "" {
-			fmt.Println("Can't send text: user 'from' phone number empty")
-			return
-		}
-		twclient := twirest.NewClient(twilioSID, twilioToken)
-		//TODO: should probably cache twclient for reuse (are we leaking these now?)
-		msg := twirest.SendMessage{
-			Text: m.Preamble + ": " + n.Subject,
-			To:   e164norm(m.Address),
-			From: e164norm(twilioFrom)}
-		_, err := twclient.Request(msg)
-		if err != nil {
-			fmt.Println("Twilio text request error: ", err)
-			return
 		}
 
-	case ModeVoice:
-		if m.Address == "" {
-			fmt.Println("Can't send voice message: method address empty")
-			return
-		}
-		if twilioFrom == "" {
-			fmt.Println("Can't send voice message: user 'from' phone number empty")
-			return
+		if r.Stop {
+			break
 		}
-		twclient := twirest.NewClient(twilioSID, twilioToken)
-		//TODO: again, need to cache this (probably in Userinfo)
-		twimlurl := "http://twimlets.com/message?Message%5B0%5D=" + url.QueryEscape(m.Preamble+" "+n.Subject)
-
-		msg := twirest.MakeCall{
-			From: e164norm(twilioFrom),
-			To:   e164norm(m.Address),
-			Url:  twimlurl}
-		_, err := twclient.Request(msg)
-		if err != nil {
-			fmt.Println("Twilio voice request error: ", err)
-			return
+	} // for rules.Next
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
 		}
+	}
+	return false
+}
 
-	} // switch m.mode
+// Push a notif through the Deliverer registered for the method's mode
+func doMethod(m Method, n notif.Notif, user notif.Userinfo, site notif.Siteinfo) DeliveryResult {
+	d, ok := deliverers[m.Mode]
+	if !ok {
+		return permanentFailure(fmt.Errorf("no deliverer for method mode %d", m.Mode))
+	}
+	return d.Deliver(m, n, user, site)
 } // doMethod
 
 //Normalize a string to E.164 format
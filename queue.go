@@ -0,0 +1,307 @@
+/*
+
+queue.go - Persistent delivery queue for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* Every (notif, method) pair selected by ProcessRules becomes a row in
+the delivery table. The queue worker picks up due jobs, pushes them
+through doMethod, and either marks them sent, schedules a retry with
+exponential backoff, or gives up and marks them dead. Since all of the
+state is in the database, jobs that were pending (or in progress) when
+the agent stopped are picked up again when it restarts. */
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"sync"
+	"time"
+)
+
+// Values of the delivery.state column
+const (
+	JobPending    = "pending"    // Waiting for next_attempt
+	JobSending    = "sending"    // Claimed by the queue worker
+	JobSent       = "sent"       // Delivered
+	JobDead       = "dead"       // Permanent failure or too many attempts
+	JobCancelled  = "cancelled"  // Notif deleted or expired before delivery
+	JobHeld       = "held"       // Waiting for the end of the user's quiet hours
+	JobDigest     = "digest"     // Waiting for the user's next digest
+	JobSummarized = "summarized" // Released as part of a summary notif
+)
+
+const (
+	queueMaxAttempts = 8                // Attempts before a job is dead-lettered
+	queueBaseBackoff = 30 * time.Second // Delay after first failure, doubled each time
+	queueMaxBackoff  = time.Hour
+	queuePoll        = 5 * time.Second // Interval between scans for due jobs
+	queueBatch       = 20              // Jobs claimed per scan
+	queueWorkers     = 4               // Concurrent deliveries
+)
+
+type deliveryQueue struct {
+	Db   *sql.DB
+	Site notif.Siteinfo
+	wake chan struct{}
+	quit chan struct{} //Closed to stop the worker
+	done chan struct{} //Closed when the worker has stopped
+}
+
+type deliveryJob struct {
+	Id       int
+	NotID    string
+	MethodID int
+	UserID   int
+	Attempts int
+}
+
+func newDeliveryQueue(db *sql.DB, site notif.Siteinfo) *deliveryQueue {
+	return &deliveryQueue{Db: db, Site: site, wake: make(chan struct{}, 1),
+		quit: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Add a delivery job for a notif and method, due immediately
+func (q *deliveryQueue) enqueue(n notif.Notif, m Method) error {
+	err := insertJob(q.Db, n, m, JobPending)
+	if err != nil {
+		return err
+	}
+	q.nudge()
+	return nil
+}
+
+// Add a delivery job to be released when quiet hours end
+func (q *deliveryQueue) hold(n notif.Notif, m Method) error {
+	return insertJob(q.Db, n, m, JobHeld)
+}
+
+func insertJob(db dbHandle, n notif.Notif, m Method, state string) error {
+	now := time.Now()
+	_, err := db.Exec(`INSERT INTO delivery (notid,method_id,user_id,state,attempts,next_attempt,last_error,created) VALUES ($1,$2,$3,$4,0,$5,'',$5)`,
+		n.NotID, m.Id, n.UserID, state, now)
+	return err
+}
+
+// Wake the worker without waiting for the next poll
+func (q *deliveryQueue) nudge() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel any deliveries of a notif that haven't happened yet
+func (q *deliveryQueue) cancel(notid string) error {
+	_, err := q.Db.Exec(`UPDATE delivery SET state = $1 WHERE notid = $2 AND state IN ($3, $4, $5)`, JobCancelled, notid, JobPending, JobHeld, JobDigest)
+	return err
+}
+
+// Queue worker; runs until stop is called
+func (q *deliveryQueue) run() {
+	defer close(q.done)
+
+	// Anything left in the sending state was interrupted by a restart
+	_, err := q.Db.Exec(`UPDATE delivery SET state = $1 WHERE state = $2`, JobPending, JobSending)
+	if err != nil {
+		fmt.Println("Queue: Recovery error: ", err)
+	}
+
+	ticker := time.NewTicker(queuePoll)
+	defer ticker.Stop()
+
+	for {
+		for q.runBatch() == queueBatch {
+			// Full batch; there may be more due right now
+			if q.stopping() {
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+func (q *deliveryQueue) stopping() bool {
+	select {
+	case <-q.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the worker after the batch in progress, waiting for it until ctx
+// is done. Jobs not yet claimed stay pending for the next run.
+func (q *deliveryQueue) stop(ctx context.Context) error {
+	close(q.quit)
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Claim and deliver up to queueBatch due jobs; returns the number claimed.
+// On a database error it returns early with a short count, so that run
+// waits for the next poll rather than trying again at once.
+func (q *deliveryQueue) runBatch() int {
+	var jobs []deliveryJob
+
+	rows, err := q.Db.Query(`SELECT id,notid,method_id,user_id,attempts FROM delivery WHERE state = $1 AND next_attempt <= $2 ORDER BY next_attempt LIMIT $3`,
+		JobPending, time.Now(), queueBatch)
+	if err != nil {
+		fmt.Println("Queue: Job query error: ", err)
+		return 0
+	}
+	for rows.Next() {
+		var j deliveryJob
+		err = rows.Scan(&j.Id, &j.NotID, &j.MethodID, &j.UserID, &j.Attempts)
+		if err != nil {
+			fmt.Println("Queue: Job scan error: ", err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, queueWorkers)
+	claimed := 0
+
+	for _, j := range jobs {
+		res, err := q.Db.Exec(`UPDATE delivery SET state = $1 WHERE id = $2 AND state = $3`, JobSending, j.Id, JobPending)
+		if err != nil {
+			fmt.Println("Queue: Job claim error: ", err)
+			break
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			continue // cancelled in the meantime
+		}
+		claimed++
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(j deliveryJob) {
+			defer wg.Done()
+			q.deliver(j)
+			<-sem
+		}(j)
+	}
+	wg.Wait()
+	return claimed
+}
+
+// Attempt a single claimed job and record the outcome
+func (q *deliveryQueue) deliver(j deliveryJob) {
+	var n notif.Notif
+	var m Method
+	var user notif.Userinfo
+
+	err := findNotif(q.Db, j.NotID, &n)
+	if err != nil {
+		q.finish(j, permanentFailure(fmt.Errorf("notif %s not found: %v", j.NotID, err)))
+		return
+	}
+	if n.Deleted {
+		q.setState(j, JobCancelled, "notif deleted")
+		return
+	}
+	if n.Expired(time.Now()) {
+		q.setState(j, JobCancelled, "notif expired")
+		return
+	}
+
+	err = findMethod(q.Db, j.MethodID, &m)
+	if err != nil {
+		q.finish(j, permanentFailure(fmt.Errorf("method %d not found: %v", j.MethodID, err)))
+		return
+	}
+
+	err = findUser(q.Db, j.UserID, &user)
+	if err != nil {
+		q.finish(j, retryableFailure(fmt.Errorf("can't retrieve user info: %v", err)))
+		return
+	}
+
+	q.finish(j, doMethod(m, n, user, q.Site))
+}
+
+// Update a job following a delivery attempt
+func (q *deliveryQueue) finish(j deliveryJob, res DeliveryResult) {
+	j.Attempts++
+
+	// A Deliverer may report a failure without saying why
+	lasterr := res.Status.String()
+	if res.Err != nil {
+		lasterr = res.Err.Error()
+	}
+
+	switch res.Status {
+	case DeliverySent:
+		q.setState(j, JobSent, "")
+		return
+	case DeliveryRetryableFailure:
+		if j.Attempts < queueMaxAttempts {
+			next := time.Now().Add(queueBackoff(j.Attempts))
+			fmt.Println("Queue: Delivery ", j.Id, " attempt ", j.Attempts, " failed, retrying at ", next, ": ", lasterr)
+			_, err := q.Db.Exec(`UPDATE delivery SET state = $1, attempts = $2, next_attempt = $3, last_error = $4 WHERE id = $5`,
+				JobPending, j.Attempts, next, lasterr, j.Id)
+			if err != nil {
+				fmt.Println("Queue: Job update error: ", err)
+			}
+			return
+		}
+	}
+
+	fmt.Println("Queue: Delivery ", j.Id, " dead after ", j.Attempts, " attempt(s): ", lasterr)
+	q.setState(j, JobDead, lasterr)
+}
+
+func (q *deliveryQueue) setState(j deliveryJob, state string, lasterr string) {
+	_, err := q.Db.Exec(`UPDATE delivery SET state = $1, attempts = $2, last_error = $3 WHERE id = $4`,
+		state, j.Attempts, lasterr, j.Id)
+	if err != nil {
+		fmt.Println("Queue: Job update error: ", err)
+	}
+}
+
+// Delay before the next attempt after the given number of failures
+func queueBackoff(attempts int) time.Duration {
+	d := queueBaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= queueMaxBackoff {
+			return queueMaxBackoff
+		}
+	}
+	return d
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/jimfenton/notif-agent/notif"
+	"testing"
+	"time"
+)
+
+func TestQueueBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, queueMaxBackoff},
+		{100, queueMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := queueBackoff(tt.attempts); got != tt.want {
+			t.Errorf("queueBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestQueueFinish(t *testing.T) {
+	failed := errors.New("connection refused")
+
+	tests := []struct {
+		name     string
+		attempts int // Before this one
+		res      DeliveryResult
+		state    string
+		lasterr  string
+	}{
+		{"sent", 0, deliverySent(), JobSent, ""},
+		{"retry", 0, retryableFailure(failed), JobPending, failed.Error()},
+		{"last retry", queueMaxAttempts - 2, retryableFailure(failed), JobPending, failed.Error()},
+		{"too many attempts", queueMaxAttempts - 1, retryableFailure(failed), JobDead, failed.Error()},
+		{"permanent", 0, permanentFailure(failed), JobDead, failed.Error()},
+		{"retry without reason", 0, DeliveryResult{Status: DeliveryRetryableFailure}, JobPending, "retryable failure"},
+		{"permanent without reason", 0, DeliveryResult{Status: DeliveryPermanentFailure}, JobDead, "permanent failure"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			q := newDeliveryQueue(db, notif.Siteinfo{})
+
+			before := time.Now()
+			q.finish(deliveryJob{Id: 11, Attempts: tt.attempts}, tt.res)
+
+			updates := f.args("UPDATE delivery SET state")
+			if len(updates) != 1 {
+				t.Fatalf("%d job updates, want 1", len(updates))
+			}
+			u := updates[0]
+			if u[0] != tt.state || u[1] != int64(tt.attempts+1) {
+				t.Errorf("state %v attempts %v, want %q %d", u[0], u[1], tt.state, tt.attempts+1)
+			}
+
+			if tt.state != JobPending {
+				if u[2] != tt.lasterr {
+					t.Errorf("last error %q, want %q", u[2], tt.lasterr)
+				}
+				return
+			}
+			next := u[2].(time.Time)
+			if backoff := queueBackoff(tt.attempts + 1); next.Before(before.Add(backoff)) || next.After(time.Now().Add(backoff)) {
+				t.Errorf("next attempt in %v, want %v", next.Sub(before), backoff)
+			}
+			if u[3] != tt.lasterr {
+				t.Errorf("last error %q, want %q", u[3], tt.lasterr)
+			}
+		})
+	}
+}
+
+// Jobs left sending by a restart are pending again before the first batch
+func TestQueueRecovery(t *testing.T) {
+	db, f := newFakeDB(t)
+	q := newDeliveryQueue(db, notif.Siteinfo{})
+	go q.run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	recovery := f.args("UPDATE delivery SET state = $1 WHERE state = $2")
+	if len(recovery) != 1 || recovery[0][0] != JobPending || recovery[0][1] != JobSending {
+		t.Errorf("recovery updates %v, want sending jobs made pending", recovery)
+	}
+	if !f.ran("SELECT id,notid,method_id,user_id,attempts FROM delivery") {
+		t.Error("no batch run")
+	}
+}
+
+func TestQueueClaim(t *testing.T) {
+	job := []driver.Value{int64(11), testNotID, int64(2), int64(7), int64(0)}
+	claim := "UPDATE delivery SET state = $1 WHERE id = $2 AND state = $3"
+
+	tests := []struct {
+		name    string
+		claim   fakeResult
+		claimed int
+	}{
+		{"claimed", fakeResult{Affected: 1}, 2},
+		{"cancelled meanwhile", fakeResult{Affected: 0}, 0},
+		{"claim error", fakeResult{Err: errors.New("connection reset")}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			f.rows("FROM delivery WHERE state = $1 AND next_attempt", job, job)
+			f.on(claim, tt.claim)
+			q := newDeliveryQueue(db, notif.Siteinfo{})
+
+			if n := q.runBatch(); n != tt.claimed {
+				t.Errorf("%d claimed, want %d", n, tt.claimed)
+			}
+			attempts := len(f.args("FROM notification WHERE notid"))
+			if attempts != tt.claimed {
+				t.Errorf("%d deliveries attempted, want %d", attempts, tt.claimed)
+			}
+			if tt.claim.Err != nil && len(f.args(claim)) != 1 {
+				t.Errorf("%d claims tried after an error, want 1", len(f.args(claim)))
+			}
+		})
+	}
+}
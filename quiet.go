@@ -0,0 +1,164 @@
+/*
+
+quiet.go - Quiet hours for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* During a user's quiet hours, text and voice pushes of Routine and
+Informational notifs (and Priority ones, if the user chooses) are held
+in the delivery queue rather than sent. Emergency notifs are always
+sent. When the quiet hours end, the held pushes for each method are
+released: a single one is sent as it is, and several are replaced by a
+summary. */
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"time"
+)
+
+const releaseInterval = time.Minute
+
+// Find a user's quiet hours
+func findQuiet(db *sql.DB, userID int) ([]notif.QuietWindow, error) {
+	var quiet []notif.QuietWindow
+
+	rows, err := db.Query(`SELECT id, user_id, days, start_hour, end_hour FROM quiet WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var q notif.QuietWindow
+		err = rows.Scan(&q.Id, &q.UserID, &q.Days, &q.StartHour, &q.EndHour)
+		if err != nil {
+			return nil, err
+		}
+		quiet = append(quiet, q)
+	}
+	return quiet, rows.Err()
+}
+
+// Whether it's quiet hours for the user at now
+func quietNow(user notif.Userinfo, now time.Time) bool {
+	if len(user.Quiet) == 0 {
+		return false
+	}
+	t := now.In(userLocation(user))
+	for _, q := range user.Quiet {
+		if inHours(q.Days, q.StartHour, q.EndHour, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a push of a notif by a method should be held for quiet hours
+func quietHold(user notif.Userinfo, m Method, n notif.Notif, now time.Time) bool {
+	if m.Mode != ModeText && m.Mode != ModeVoice {
+		return false
+	}
+	switch n.Priority {
+	case notif.PriEmergency:
+		return false
+	case notif.PriPriority:
+		if !user.QuietPriority {
+			return false
+		}
+	}
+	return quietNow(user, now)
+}
+
+// Release held pushes for users whose quiet hours are over; run every
+// releaseInterval
+func releaseHeld(db *sql.DB, q *deliveryQueue) {
+	var users []int
+
+	rows, err := db.Query(`SELECT DISTINCT user_id FROM delivery WHERE state = $1`, JobHeld)
+	if err != nil {
+		fmt.Println("Quiet: Held delivery query error: ", err)
+		return
+	}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err == nil {
+			users = append(users, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range users {
+		var user notif.Userinfo
+
+		err = findUser(db, id, &user)
+		if err != nil {
+			fmt.Println("Quiet: Can't retrieve user info: ", err, " user ", id)
+			continue
+		}
+		if !quietNow(user, time.Now()) {
+			releaseUser(db, q, user)
+		}
+	}
+}
+
+// Release a user's held pushes, summarizing them by method
+func releaseUser(db *sql.DB, q *deliveryQueue, user notif.Userinfo) {
+	var m Method
+	now := time.Now()
+
+	methods, held, err := findHeld(db, user.UserID, JobHeld)
+	if err != nil {
+		fmt.Println("Quiet: Held delivery query error: ", err)
+		return
+	}
+
+	for _, methodID := range methods {
+		live := liveJobs(db, held[methodID], JobHeld, now)
+
+		switch len(live) {
+		case 0:
+			continue
+		case 1:
+			_, err = db.Exec(`UPDATE delivery SET state = $1, next_attempt = $2 WHERE id = $3 AND state = $4`, JobPending, now, live[0].Id, JobHeld)
+			if err != nil {
+				fmt.Println("Quiet: Delivery update error: ", err)
+			}
+			continue
+		}
+
+		err = findMethod(db, methodID, &m)
+		if err != nil {
+			fmt.Println("Quiet: Method query error: ", err)
+			continue
+		}
+		err = summarizeJobs(db, user, live, JobHeld, m, "held during quiet hours", now)
+		if err != nil {
+			fmt.Println("Quiet: Summary error: ", err)
+		}
+	}
+	q.nudge()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/jimfenton/notif-agent/notif"
+	"testing"
+	"time"
+)
+
+func TestQuietHold(t *testing.T) {
+	at := func(day int, hour int) time.Time {
+		return time.Date(2024, time.January, day, hour, 0, 0, 0, time.UTC) // January 1 is a Monday
+	}
+	weeknights := notif.Userinfo{Quiet: []notif.QuietWindow{{Days: weekdays, StartHour: 22, EndHour: 7}}}
+	alsoPriority := weeknights
+	alsoPriority.QuietPriority = true
+	text := Method{Mode: ModeText}
+
+	tests := []struct {
+		name string
+		user notif.Userinfo
+		m    Method
+		pri  notif.NotifPri
+		t    time.Time
+		want bool
+	}{
+		{"Friday night", weeknights, text, notif.PriRoutine, at(5, 23), true},
+		{"Saturday 3am", weeknights, text, notif.PriInformational, at(6, 3), true},
+		{"Saturday night", weeknights, text, notif.PriRoutine, at(6, 23), false},
+		{"Monday 3am", weeknights, text, notif.PriRoutine, at(1, 3), false},
+		{"Tuesday 3am", weeknights, text, notif.PriRoutine, at(2, 3), true},
+		{"daytime", weeknights, text, notif.PriRoutine, at(2, 12), false},
+		{"voice", weeknights, Method{Mode: ModeVoice}, notif.PriRoutine, at(2, 3), true},
+		{"email", weeknights, Method{Mode: ModeEmail}, notif.PriRoutine, at(2, 3), false},
+		{"emergency", alsoPriority, text, notif.PriEmergency, at(2, 3), false},
+		{"priority", weeknights, text, notif.PriPriority, at(2, 3), false},
+		{"priority held", alsoPriority, text, notif.PriPriority, at(2, 3), true},
+		{"no quiet hours", notif.Userinfo{}, text, notif.PriRoutine, at(2, 3), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quietHold(tt.user, tt.m, notif.Notif{Priority: tt.pri}, tt.t); got != tt.want {
+				t.Errorf("quietHold = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+/*
+
+replay.go - Replay protection for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* Signed requests carry a nonce (jti) and the time they were signed (iat)
+in the protected header. Requests signed too long ago, or too far in the
+future, are refused; for the rest the nonce is remembered long enough
+to cover the whole window so that a captured request can't be sent
+again. The cache is kept in memory and bounded in size, so a restart
+(or a flood of distinct nonces) reopens a window no larger than
+replayWindow. */
+
+import (
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"sync"
+	"time"
+)
+
+const (
+	replayWindow    = 10 * time.Minute // Allowed difference between iat and now
+	replayCacheSize = 100000           // Nonces remembered
+)
+
+type replayEntry struct {
+	key     string
+	expires time.Time
+}
+
+type replayCache struct {
+	sync.Mutex
+	seen  map[string]time.Time // Nonces and when they can be forgotten
+	order []replayEntry        // Same, oldest first
+	max   int
+	ttl   time.Duration
+}
+
+func newReplayCache(max int, ttl time.Duration) *replayCache {
+	return &replayCache{seen: make(map[string]time.Time), max: max, ttl: ttl}
+}
+
+// Record a nonce; returns true if it was already present (a replay)
+func (c *replayCache) seenBefore(key string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	// Entries all have the same TTL, so expire from the front
+	for len(c.order) > 0 && (len(c.order) >= c.max || !now.Before(c.order[0].expires)) {
+		if c.seen[c.order[0].key] == c.order[0].expires {
+			delete(c.seen, c.order[0].key)
+		}
+		c.order = c.order[1:]
+	}
+
+	if exp, ok := c.seen[key]; ok && now.Before(exp) {
+		return true
+	}
+	exp := now.Add(c.ttl)
+	c.seen[key] = exp
+	c.order = append(c.order, replayEntry{key, exp})
+	return false
+}
+
+// Check the nonce and timestamp of a request whose signature has been
+// verified. Returns nil if the request may proceed.
+func (ag agent) checkReplay(npr notifProtected, auth notif.Auth) *apiError {
+	if npr.Nonce == "" || npr.IssuedAt == 0 {
+		if ag.RequireNonce {
+			return &apiError{CodeNonceRequired, "Nonce and timestamp required"}
+		}
+		fmt.Println("Accepting request without nonce from legacy notifier ", auth.Domain)
+		return nil
+	}
+
+	now := time.Now()
+	iat := time.Unix(npr.IssuedAt, 0)
+	if iat.Before(now.Add(-replayWindow)) || iat.After(now.Add(replayWindow)) {
+		return &apiError{CodeStaleTimestamp, "Timestamp outside allowed window"}
+	}
+
+	// Nonces are per notifier domain, so a request can't be replayed
+	// against another of its authorizations either
+	if ag.Replay.seenBefore(auth.Domain+" "+npr.Nonce, now) {
+		fmt.Println("Replayed request from ", auth.Domain, " nonce ", npr.Nonce)
+		return &apiError{CodeReplay, "Replayed request"}
+	}
+	return nil
+}
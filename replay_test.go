@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplayCacheDuplicate(t *testing.T) {
+	c := newReplayCache(10, time.Minute)
+	now := time.Now()
+
+	if c.seenBefore("a", now) {
+		t.Error("new nonce reported as seen")
+	}
+	if !c.seenBefore("a", now.Add(59*time.Second)) {
+		t.Error("repeated nonce not detected")
+	}
+	if c.seenBefore("b", now) {
+		t.Error("other nonce reported as seen")
+	}
+}
+
+func TestReplayCacheExpiry(t *testing.T) {
+	c := newReplayCache(10, time.Minute)
+	now := time.Now()
+
+	c.seenBefore("a", now)
+	c.seenBefore("b", now.Add(30*time.Second))
+	if c.seenBefore("a", now.Add(time.Minute)) {
+		t.Error("nonce remembered past its TTL")
+	}
+	if !c.seenBefore("b", now.Add(time.Minute)) {
+		t.Error("nonce forgotten before its TTL")
+	}
+	if len(c.seen) != len(c.order) {
+		t.Errorf("%d nonces but %d in order", len(c.seen), len(c.order))
+	}
+}
+
+func TestReplayCacheBound(t *testing.T) {
+	const max = 3
+	c := newReplayCache(max, time.Hour)
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		c.seenBefore(fmt.Sprint(i), now)
+		if len(c.seen) > max || len(c.order) > max {
+			t.Fatalf("%d nonces remembered, limit %d", len(c.seen), max)
+		}
+	}
+	if !c.seenBefore("99", now) {
+		t.Error("newest nonce evicted")
+	}
+	if c.seenBefore("0", now) {
+		t.Error("oldest nonce not evicted")
+	}
+}
+
+func TestReplayCacheConcurrent(t *testing.T) {
+	c := newReplayCache(1000, time.Minute)
+	now := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	fresh := 0
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !c.seenBefore("same", now) {
+				mu.Lock()
+				fresh++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if fresh != 1 {
+		t.Errorf("nonce accepted %d times, want once", fresh)
+	}
+}
+
+func TestCheckReplay(t *testing.T) {
+	now := time.Now()
+	auth := notif.Auth{Domain: "example.com"}
+	other := notif.Auth{Domain: "example.net"}
+
+	tests := []struct {
+		name    string
+		require bool
+		first   notifProtected // Sent beforehand, if it has a nonce
+		auth    notif.Auth
+		npr     notifProtected
+		code    string // "" if accepted
+	}{
+		{name: "fresh", npr: notifProtected{Nonce: "n1", IssuedAt: now.Unix()}},
+		{name: "signed a while ago", npr: notifProtected{Nonce: "n1", IssuedAt: now.Add(-9 * time.Minute).Unix()}},
+		{name: "clock ahead", npr: notifProtected{Nonce: "n1", IssuedAt: now.Add(9 * time.Minute).Unix()}},
+		{name: "stale", npr: notifProtected{Nonce: "n1", IssuedAt: now.Add(-11 * time.Minute).Unix()}, code: CodeStaleTimestamp},
+		{name: "future", npr: notifProtected{Nonce: "n1", IssuedAt: now.Add(11 * time.Minute).Unix()}, code: CodeStaleTimestamp},
+		{name: "replayed", first: notifProtected{Nonce: "n1", IssuedAt: now.Unix()},
+			npr: notifProtected{Nonce: "n1", IssuedAt: now.Unix()}, code: CodeReplay},
+		{name: "replayed with new iat", first: notifProtected{Nonce: "n1", IssuedAt: now.Unix()},
+			npr: notifProtected{Nonce: "n1", IssuedAt: now.Unix() + 1}, code: CodeReplay},
+		{name: "same nonce other domain", first: notifProtected{Nonce: "n1", IssuedAt: now.Unix()}, auth: other,
+			npr: notifProtected{Nonce: "n1", IssuedAt: now.Unix()}},
+		{name: "legacy", npr: notifProtected{}},
+		{name: "legacy nonce only", npr: notifProtected{Nonce: "n1"}},
+		{name: "legacy refused", require: true, npr: notifProtected{}, code: CodeNonceRequired},
+		{name: "nonce only refused", require: true, npr: notifProtected{Nonce: "n1"}, code: CodeNonceRequired},
+		{name: "required", require: true, npr: notifProtected{Nonce: "n1", IssuedAt: now.Unix()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ag := agent{Replay: newReplayCache(replayCacheSize, 2*replayWindow), RequireNonce: tt.require}
+			if tt.first.Nonce != "" {
+				if aerr := ag.checkReplay(tt.first, auth); aerr != nil {
+					t.Fatalf("first request: %v", aerr)
+				}
+			}
+			a := tt.auth
+			if a.Domain == "" {
+				a = auth
+			}
+
+			aerr := ag.checkReplay(tt.npr, a)
+			switch {
+			case tt.code == "" && aerr != nil:
+				t.Errorf("refused: %s", aerr.Code)
+			case tt.code != "" && (aerr == nil || aerr.Code != tt.code):
+				t.Errorf("got %v, want %s", aerr, tt.code)
+			}
+		})
+	}
+}
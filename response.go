@@ -0,0 +1,156 @@
+/*
+
+response.go - Native API responses for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* Every response from the native API is a JSON object. Errors have the
+form
+
+  {"error": "<code>", "message": "<description>", "notid": "<notID>"}
+
+where the code is one of the constants below, and notid is present when
+the request concerned an existing notif. Codes are stable so notifiers
+can act on them; messages are for people and may change. The HTTP
+status for each code is given by codeStatus, so that it is consistent
+throughout the handler. */
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"net/http"
+)
+
+// Error codes
+const (
+	CodeMethodNotAllowed  = "method_not_allowed"
+	CodeUnsupportedMedia  = "unsupported_media_type"
+	CodeTooLarge          = "request_too_large"
+	CodeReadFailed        = "read_failed"
+	CodeBadMessage        = "bad_message"
+	CodeBadPayload        = "bad_payload"
+	CodeBadProtected      = "bad_protected_header"
+	CodeExpiresBeforeOrig = "expires_before_origtime"
+	CodeAlreadyExpired    = "already_expired"
+	CodeOrigtimeInFuture  = "origtime_in_future"
+	CodeBadPriority       = "bad_priority"
+	CodeAuthNotFound      = "authorization_not_found"
+	CodeAuthInactive      = "authorization_inactive"
+	CodeAuthExpired       = "authorization_expired"
+	CodeNotifNotFound     = "notif_not_found"
+	CodeOutOfOrder        = "out_of_order_update"
+	CodeNotifDeleted      = "notif_deleted"
+	CodeUnsupportedAlg    = "unsupported_algorithm"
+	CodeKeyNotFound       = "key_not_found"
+	CodeKeyLookupFailed   = "key_lookup_failed"
+	CodeKeyRevoked        = "key_revoked"
+	CodeKeyChanged        = "key_changed"
+	CodeBadSignature      = "bad_signature"
+	CodeSignatureInvalid  = "signature_invalid"
+	CodeNonceRequired     = "nonce_required"
+	CodeStaleTimestamp    = "timestamp_out_of_window"
+	CodeReplay            = "replayed_request"
+	CodeInternal          = "internal_error"
+)
+
+var codeStatus = map[string]int{
+	CodeMethodNotAllowed:  http.StatusMethodNotAllowed,
+	CodeUnsupportedMedia:  http.StatusUnsupportedMediaType,
+	CodeTooLarge:          http.StatusRequestEntityTooLarge,
+	CodeReadFailed:        http.StatusBadRequest,
+	CodeBadMessage:        http.StatusBadRequest,
+	CodeBadPayload:        http.StatusBadRequest,
+	CodeBadProtected:      http.StatusBadRequest,
+	CodeExpiresBeforeOrig: http.StatusBadRequest,
+	CodeAlreadyExpired:    http.StatusGone,
+	CodeOrigtimeInFuture:  http.StatusUnprocessableEntity,
+	CodeBadPriority:       http.StatusBadRequest,
+	CodeUnsupportedAlg:    http.StatusBadRequest,
+	CodeAuthNotFound:      http.StatusNotFound,
+	CodeNotifNotFound:     http.StatusNotFound,
+	CodeAuthInactive:      http.StatusForbidden,
+	CodeAuthExpired:       http.StatusForbidden,
+	CodeKeyChanged:        http.StatusForbidden,
+	CodeReplay:            http.StatusForbidden,
+	CodeOutOfOrder:        http.StatusConflict,
+	CodeNotifDeleted:      http.StatusConflict,
+
+	// The request couldn't be authenticated
+	CodeKeyNotFound:      http.StatusUnauthorized,
+	CodeKeyRevoked:       http.StatusUnauthorized,
+	CodeBadSignature:     http.StatusUnauthorized,
+	CodeSignatureInvalid: http.StatusUnauthorized,
+	CodeNonceRequired:    http.StatusUnauthorized,
+	CodeStaleTimestamp:   http.StatusUnauthorized,
+
+	CodeKeyLookupFailed: http.StatusServiceUnavailable,
+	CodeInternal:        http.StatusInternalServerError,
+}
+
+type apiResponse struct {
+	NotID    string         `json:"notid,omitempty"`
+	Priority notif.NotifPri `json:"priority,omitempty"` //Priority stored, after any cap
+	Capped   bool           `json:"capped,omitempty"`   //Priority lowered to the authorization's limit
+	Error    string         `json:"error,omitempty"`    //Error code
+	Message  string         `json:"message,omitempty"`  //Error description
+}
+
+// A request failure, as found by one of the checks done by ServeHTTP
+type apiError struct {
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func (e *apiError) write(w http.ResponseWriter, notid string) {
+	writeError(w, e.Code, e.Message, notid)
+}
+
+func writeError(w http.ResponseWriter, code string, message string, notid string) {
+	status, ok := codeStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `JWS realm="notifs"`)
+	}
+	writeJSON(w, status, apiResponse{NotID: notid, Error: code, Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Response marshal error: ", err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":"` + CodeInternal + `","message":"Response marshal error"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,150 @@
+/*
+
+rules.go - Rule matching for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* A rule selects a method for the notifs it matches. Every condition
+that is set must hold:
+
+  domain        "" matches any domain; ".example.com" matches
+                example.com and its subdomains; anything else is a
+                shell-style pattern such as "*.example.com"
+  priority      exactly this priority (0 for any)
+  min_priority  at least as urgent as this priority (0 for any)
+  auth_id       only notifs received under this authorization
+  subject       keyword contained in the subject, ignoring case, or a
+                regular expression if subject_regex is set
+  days          bitmask of weekdays (1 = Sunday ... 64 = Saturday,
+                0 for every day) in the user's time zone
+  start_hour,   hours of the day [start_hour, end_hour) in the user's
+  end_hour      time zone; the window wraps past midnight if start_hour
+                is later (and then belongs to the day it starts on),
+                and covers the whole day if they are equal
+
+Rules are tried in order of seq. A matching rule with stop set ends
+processing of the notif after its method is queued. */
+
+import (
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Whether a rule applies to a notif received at now
+func ruleMatches(r notif.Rule, n notif.Notif, loc *time.Location, now time.Time) bool {
+	if !r.Active {
+		return false
+	}
+	if r.Priority != 0 && r.Priority != n.Priority {
+		return false
+	}
+	if r.MinPriority != 0 && n.Priority > r.MinPriority {
+		return false
+	}
+	if r.AuthID != 0 && r.AuthID != n.AuthID {
+		return false
+	}
+	if !domainMatches(r.Domain, n.From) {
+		return false
+	}
+	if r.Subject != "" && !subjectMatches(r, n.Subject) {
+		return false
+	}
+	return inHours(r.Days, r.StartHour, r.EndHour, now.In(loc))
+}
+
+// Match a domain against a rule's domain pattern
+func domainMatches(pattern string, domain string) bool {
+	if pattern == "" {
+		return true
+	}
+	pattern = strings.ToLower(pattern)
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if strings.HasPrefix(pattern, ".") {
+		return domain == pattern[1:] || strings.HasSuffix(domain, pattern)
+	}
+	matched, err := path.Match(pattern, domain)
+	if err != nil {
+		fmt.Println("Rule: Bad domain pattern ", pattern, ": ", err)
+		return false
+	}
+	return matched
+}
+
+// Match a subject against a rule's keyword or regular expression
+func subjectMatches(r notif.Rule, subject string) bool {
+	if !r.SubjectRegex {
+		return strings.Contains(strings.ToLower(subject), strings.ToLower(r.Subject))
+	}
+	re, err := regexp.Compile(r.Subject)
+	if err != nil {
+		fmt.Println("Rule: Bad subject expression in rule ", r.Id, ": ", err)
+		return false
+	}
+	return re.MatchString(subject)
+}
+
+// Whether a local time falls in the hours [start, end) of one of a
+// bitmask of weekdays (0 for any). The hours wrap past midnight if start
+// is later, and cover the whole day if they are equal. A window that
+// wraps belongs to the day it starts on, so the early hours of Saturday
+// are in a Friday 22-7 window.
+func inHours(days int, start int, end int, t time.Time) bool {
+	h := t.Hour()
+	day := t.Weekday()
+
+	switch {
+	case start == end:
+	case start < end:
+		if h < start || h >= end {
+			return false
+		}
+	case h >= start:
+	case h < end:
+		day = (day + 6) % 7 //Started the day before
+	default:
+		return false
+	}
+	return days == 0 || days&(1<<uint(day)) != 0
+}
+
+// The user's time zone, or the agent's if the user hasn't set one or it
+// isn't known
+func userLocation(user notif.Userinfo) *time.Location {
+	if user.TimeZone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil {
+		fmt.Println("Unknown time zone ", user.TimeZone, " for user ", user.UserID)
+		return time.Local
+	}
+	return loc
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql/driver"
+	"github.com/jimfenton/notif-agent/notif"
+	"testing"
+	"time"
+)
+
+// Monday, 10:00 UTC
+var testMonday = time.Date(2024, time.January, 1, 10, 0, 0, 0, time.UTC)
+
+const (
+	sunday = 1 << iota
+	monday
+	tuesday
+	wednesday
+	thursday
+	friday
+	saturday
+	weekdays = monday | tuesday | wednesday | thursday | friday
+)
+
+func TestRuleMatches(t *testing.T) {
+	n := notif.Notif{From: "alerts.example.com", Subject: "Door OPEN in garage", Priority: notif.PriPriority, AuthID: 42}
+
+	tests := []struct {
+		name string
+		rule notif.Rule
+		want bool
+	}{
+		{"any", notif.Rule{}, true},
+		{"inactive", notif.Rule{Id: -1}, false},
+		{"priority", notif.Rule{Priority: notif.PriPriority}, true},
+		{"other priority", notif.Rule{Priority: notif.PriRoutine}, false},
+		{"min priority less urgent", notif.Rule{MinPriority: notif.PriRoutine}, true},
+		{"min priority same", notif.Rule{MinPriority: notif.PriPriority}, true},
+		{"min priority more urgent", notif.Rule{MinPriority: notif.PriEmergency}, false},
+		{"authorization", notif.Rule{AuthID: 42}, true},
+		{"other authorization", notif.Rule{AuthID: 43}, false},
+		{"domain", notif.Rule{Domain: ".example.com"}, true},
+		{"other domain", notif.Rule{Domain: ".example.net"}, false},
+		{"subject", notif.Rule{Subject: "door open"}, true},
+		{"other subject", notif.Rule{Subject: "window"}, false},
+		{"hours", notif.Rule{StartHour: 9, EndHour: 17}, true},
+		{"other hours", notif.Rule{StartHour: 17, EndHour: 9}, false},
+		{"day", notif.Rule{Days: monday}, true},
+		{"other day", notif.Rule{Days: weekdays &^ monday}, false},
+		{"all conditions", notif.Rule{Priority: notif.PriPriority, MinPriority: notif.PriRoutine, AuthID: 42,
+			Domain: "*.example.com", Subject: "garage", Days: weekdays, StartHour: 8, EndHour: 12}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.rule
+			r.Active = r.Id != -1 // All active but the one marked
+			if got := ruleMatches(r, n, time.UTC, testMonday); got != tt.want {
+				t.Errorf("ruleMatches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Rule times are in the user's time zone
+func TestRuleMatchesLocation(t *testing.T) {
+	loc := time.FixedZone("UTC-8", -8*60*60)
+	r := notif.Rule{Active: true, Days: monday, StartHour: 0, EndHour: 6}
+
+	if !ruleMatches(r, notif.Notif{}, loc, testMonday) {
+		t.Error("02:00 Monday in the user's zone not matched")
+	}
+	if ruleMatches(r, notif.Notif{}, time.UTC, testMonday) {
+		t.Error("10:00 Monday UTC matched")
+	}
+}
+
+func TestDomainMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		domain  string
+		want    bool
+	}{
+		{"", "example.com", true},
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"Example.COM", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{".example.com", "example.com", true},
+		{".example.com", "www.example.com", true},
+		{".example.com", "a.b.example.com", true},
+		{".example.com", "badexample.com", false},
+		{".example.com", "example.com.evil.net", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{"alerts-?.example.com", "alerts-1.example.com", true},
+		{"[", "example.com", false},
+	}
+	for _, tt := range tests {
+		if got := domainMatches(tt.pattern, tt.domain); got != tt.want {
+			t.Errorf("domainMatches(%q, %q) = %v, want %v", tt.pattern, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		subject string
+		regex   bool
+		want    bool
+	}{
+		{"door", false, true},
+		{"DOOR open", false, true},
+		{"door closed", false, false},
+		{"^Door (open|ajar)", true, true},
+		{"^door", true, false}, // Expressions are case sensitive unless they say otherwise
+		{"(?i)^door", true, true},
+		{"[", true, false},
+		{"[", false, false},
+	}
+	for _, tt := range tests {
+		r := notif.Rule{Subject: tt.subject, SubjectRegex: tt.regex}
+		if got := subjectMatches(r, "Door open in garage"); got != tt.want {
+			t.Errorf("subjectMatches(%q, regex %v) = %v, want %v", tt.subject, tt.regex, got, tt.want)
+		}
+	}
+}
+
+func TestInHours(t *testing.T) {
+	at := func(day int, hour int) time.Time {
+		return time.Date(2024, time.January, day, hour, 30, 0, 0, time.UTC) // January 1 is a Monday
+	}
+
+	tests := []struct {
+		name       string
+		days       int
+		start, end int
+		t          time.Time
+		want       bool
+	}{
+		{"whole day", 0, 0, 0, at(1, 3), true},
+		{"whole day, equal hours", 0, 9, 9, at(1, 3), true},
+		{"daytime in", 0, 9, 17, at(1, 9), true},
+		{"daytime end", 0, 9, 17, at(1, 17), false},
+		{"daytime before", 0, 9, 17, at(1, 8), false},
+		{"overnight evening", 0, 22, 7, at(1, 23), true},
+		{"overnight morning", 0, 22, 7, at(2, 3), true},
+		{"overnight end", 0, 22, 7, at(2, 7), false},
+		{"overnight day", 0, 22, 7, at(1, 12), false},
+		{"day selected", monday, 0, 0, at(1, 12), true},
+		{"day not selected", monday, 0, 0, at(2, 12), false},
+		{"weekdays on Friday", weekdays, 9, 17, at(5, 10), true},
+		{"weekdays on Saturday", weekdays, 9, 17, at(6, 10), false},
+		{"weekend on Sunday", sunday | saturday, 0, 0, at(7, 10), true},
+		{"weeknights Friday night", weekdays, 22, 7, at(5, 23), true},
+		{"weeknights Saturday morning", weekdays, 22, 7, at(6, 3), true},
+		{"weeknights Saturday night", weekdays, 22, 7, at(6, 23), false},
+		{"weeknights Sunday night", weekdays, 22, 7, at(7, 23), false},
+		{"weeknights Monday morning", weekdays, 22, 7, at(1, 3), false},
+		{"weeknights Tuesday morning", weekdays, 22, 7, at(2, 3), true},
+		{"weeknights Monday day", weekdays, 22, 7, at(1, 12), false},
+		{"Saturday night into Sunday", saturday, 20, 2, at(7, 1), true},
+		{"Saturday night, Sunday evening", saturday, 20, 2, at(7, 21), false},
+	}
+	for _, tt := range tests {
+		if got := inHours(tt.days, tt.start, tt.end, tt.t); got != tt.want {
+			t.Errorf("%s: inHours(%b, %d, %d, %v) = %v, want %v", tt.name, tt.days, tt.start, tt.end, tt.t, got, tt.want)
+		}
+	}
+}
+
+// A row of rule as selected by ProcessRules
+func ruleRow(id int, domain string, stop bool, method int, escalation interface{}) []driver.Value {
+	return []driver.Value{int64(id), true, int64(0), int64(0), domain, nil, "", false,
+		int64(0), int64(0), int64(0), int64(id), stop, int64(method), escalation}
+}
+
+func TestProcessRules(t *testing.T) {
+	n := notif.Notif{NotID: testNotID, UserID: 7, From: "example.com", Subject: "Door open", Priority: notif.PriRoutine}
+
+	tests := []struct {
+		name     string
+		priority notif.NotifPri
+		rules    [][]driver.Value
+		methods  []int64 // Looked up, in order
+		steps    int     // Escalations started
+	}{
+		{name: "in order", rules: [][]driver.Value{
+			ruleRow(1, "", false, 3, nil), ruleRow(2, "", false, 2, nil)}, methods: []int64{3, 2}},
+		{name: "method used once", rules: [][]driver.Value{
+			ruleRow(1, "", false, 2, nil), ruleRow(2, "", false, 2, nil), ruleRow(3, "", false, 3, nil)}, methods: []int64{2, 3}},
+		{name: "stop", rules: [][]driver.Value{
+			ruleRow(1, "", false, 2, nil), ruleRow(2, "", true, 3, nil), ruleRow(3, "", false, 4, nil)}, methods: []int64{2, 3}},
+		{name: "stop not matched", rules: [][]driver.Value{
+			ruleRow(1, "other.example", true, 2, nil), ruleRow(2, "", false, 3, nil)}, methods: []int64{3}},
+		{name: "escalation started once", priority: notif.PriEmergency, rules: [][]driver.Value{
+			ruleRow(1, "", false, 2, int64(5)), ruleRow(2, "", false, 3, int64(5))}, steps: 1},
+		{name: "not urgent enough to escalate", rules: [][]driver.Value{
+			ruleRow(1, "", false, 2, int64(5))}, methods: []int64{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t)
+			f.rows("FROM rule WHERE user_id", tt.rules...)
+			f.rows("FROM method WHERE id", methodRow(2, int(ModeEmail), nil))
+			q := newDeliveryQueue(db, notif.Siteinfo{})
+			nd := n
+			if tt.priority != 0 {
+				nd.Priority = tt.priority
+			}
+
+			ProcessRules(nd, db, notif.Userinfo{UserID: 7}, q, newEscalator(db, q))
+
+			if !f.ran("ORDER BY seq") {
+				t.Error("rules not taken in order of seq")
+			}
+			var methods []int64
+			for _, a := range f.args("FROM method WHERE id") {
+				methods = append(methods, a[0].(int64))
+			}
+			if len(methods) != len(tt.methods) {
+				t.Fatalf("methods %v, want %v", methods, tt.methods)
+			}
+			for i := range methods {
+				if methods[i] != tt.methods[i] {
+					t.Fatalf("methods %v, want %v", methods, tt.methods)
+				}
+			}
+			if queued := len(f.args("INSERT INTO delivery")); queued != len(tt.methods) {
+				t.Errorf("%d deliveries queued, want %d", queued, len(tt.methods))
+			}
+			if steps := len(f.args("FROM escalation_step")); steps != tt.steps {
+				t.Errorf("%d escalations started, want %d", steps, tt.steps)
+			}
+		})
+	}
+}
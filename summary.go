@@ -0,0 +1,210 @@
+/*
+
+summary.go - Summary notifs for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+/* A summary is a notif of the agent's own that stands in for several
+notifs which weren't pushed individually. It lists them grouped by
+originating domain and authorization, and is stored and queued for a
+single method like any other notif. It has no authorization (toaddr is
+empty); its fromdomain is the agent's own domain and its source is
+"agent". The notifs to be summarized are
+delivery jobs set aside in some state other than pending (held for
+quiet hours, or collected for a digest); once summarized, they are
+marked as such. */
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"github.com/pborman/uuid"
+	"sort"
+	"time"
+)
+
+// Sender shown on summaries, which aren't from any notifier
+var agentDomain = "localhost"
+
+// Build a summary notif for a user covering the given notifs. It takes
+// the priority of the most urgent of them.
+func summaryNotif(userID int, description string, items []notif.Notif) notif.Notif {
+	var nd notif.Notif
+
+	nd.UserID = userID
+	nd.From = agentDomain
+	nd.Description = description
+	nd.Priority = notif.PriInformational
+	for _, n := range items {
+		if n.Priority < nd.Priority {
+			nd.Priority = n.Priority
+		}
+	}
+	if len(items) == 1 {
+		nd.Subject = "1 notif"
+	} else {
+		nd.Subject = fmt.Sprintf("%d notifs", len(items))
+	}
+	nd.Subject += ": " + description
+	nd.Body = summaryBody(items)
+	nd.NotID = uuid.New()
+	nd.RecvTime = time.Now()
+	nd.Origtime = nd.RecvTime
+	nd.Source = "agent"
+	return nd
+}
+
+// List notifs by domain and authorization description, oldest first
+// within each
+func summaryBody(items []notif.Notif) string {
+	var b bytes.Buffer
+
+	sorted := make([]notif.Notif, len(items))
+	copy(sorted, items)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].From != sorted[j].From {
+			return sorted[i].From < sorted[j].From
+		}
+		if sorted[i].Description != sorted[j].Description {
+			return sorted[i].Description < sorted[j].Description
+		}
+		return sorted[i].RecvTime.Before(sorted[j].RecvTime)
+	})
+
+	for i, n := range sorted {
+		if i == 0 || n.From != sorted[i-1].From || n.Description != sorted[i-1].Description {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			if n.Description != "" {
+				fmt.Fprintf(&b, "%s (%s)\n", n.From, n.Description)
+			} else {
+				fmt.Fprintf(&b, "%s\n", n.From)
+			}
+		}
+		fmt.Fprintf(&b, "  %s [%s] %s\n", n.RecvTime.Format("Jan 2 15:04"), n.Priority, n.Subject)
+	}
+	return b.String()
+}
+
+// Store a summary notif and queue it for delivery by a method, as a job
+// in the given state (pending, or held for quiet hours)
+func queueSummary(tx *sql.Tx, nd notif.Notif, m Method, state string) error {
+	err := insertNotif(tx, nd)
+	if err != nil {
+		return fmt.Errorf("summary insert: %v", err)
+	}
+	err = insertJob(tx, nd, m, state)
+	if err != nil {
+		return fmt.Errorf("summary delivery insert: %v", err)
+	}
+	return nil
+}
+
+// A delivery job set aside for a summary, with its notif
+type heldJob struct {
+	Id    int
+	Notif notif.Notif
+}
+
+// Find a user's delivery jobs in the given state, by method in order of
+// first appearance
+func findHeld(db *sql.DB, userID int, state string) ([]int, map[int][]heldJob, error) {
+	var methods []int
+	held := make(map[int][]heldJob)
+
+	rows, err := db.Query(`SELECT id, notid, method_id FROM delivery WHERE state = $1 AND user_id = $2 ORDER BY created`, state, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var j heldJob
+		var methodID int
+		err = rows.Scan(&j.Id, &j.Notif.NotID, &methodID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := held[methodID]; !ok {
+			methods = append(methods, methodID)
+		}
+		held[methodID] = append(held[methodID], j)
+	}
+	return methods, held, rows.Err()
+}
+
+// Load the notifs of jobs set aside in the given state, cancelling those
+// whose notifs have since been deleted or expired
+func liveJobs(db *sql.DB, jobs []heldJob, state string, now time.Time) []heldJob {
+	var live []heldJob
+
+	for _, j := range jobs {
+		err := findNotif(db, j.Notif.NotID, &j.Notif)
+		if err != nil || j.Notif.Deleted || j.Notif.Expired(now) {
+			cancelJobs(db, []heldJob{j}, state)
+			continue
+		}
+		live = append(live, j)
+	}
+	return live
+}
+
+// Cancel jobs set aside in the given state
+func cancelJobs(db *sql.DB, jobs []heldJob, state string) {
+	for _, j := range jobs {
+		_, err := db.Exec(`UPDATE delivery SET state = $1 WHERE id = $2 AND state = $3`, JobCancelled, j.Id, state)
+		if err != nil {
+			fmt.Println("Summary: Delivery update error: ", err)
+		}
+	}
+}
+
+// Replace jobs set aside in the given state with a summary of their
+// notifs, queued for delivery by a method. The summary is held if the
+// user's quiet hours apply to it.
+func summarizeJobs(db *sql.DB, user notif.Userinfo, jobs []heldJob, state string, m Method, description string, now time.Time) error {
+	var items []notif.Notif
+
+	for _, j := range jobs {
+		items = append(items, j.Notif)
+	}
+	nd := summaryNotif(user.UserID, description, items)
+	summaryState := JobPending
+	if quietHold(user, m, nd, now) {
+		summaryState = JobHeld
+	}
+
+	return inTx(db, func(tx *sql.Tx) error {
+		for _, j := range jobs {
+			_, err := tx.Exec(`UPDATE delivery SET state = $1 WHERE id = $2 AND state = $3`, JobSummarized, j.Id, state)
+			if err != nil {
+				return err
+			}
+		}
+		return queueSummary(tx, nd, m, summaryState)
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/jimfenton/notif-agent/notif"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummaryNotif(t *testing.T) {
+	now := time.Now()
+	items := []notif.Notif{
+		{From: "b.example", Description: "Alarm", Subject: "Door open", Priority: notif.PriRoutine, RecvTime: now},
+		{From: "a.example", Subject: "Newsletter", Priority: notif.PriInformational, RecvTime: now.Add(-time.Hour)},
+		{From: "b.example", Description: "Alarm", Subject: "Door closed", Priority: notif.PriPriority, RecvTime: now.Add(-time.Minute)},
+	}
+
+	nd := summaryNotif(7, "held during quiet hours", items)
+
+	if nd.From == "" || nd.From != agentDomain {
+		t.Errorf("from %q, want %q", nd.From, agentDomain)
+	}
+	if nd.To != "" || nd.Source != "agent" || nd.UserID != 7 || nd.NotID == "" {
+		t.Errorf("summary = %+v", nd)
+	}
+	if nd.Priority != notif.PriPriority {
+		t.Errorf("priority %d, want the most urgent, %d", nd.Priority, notif.PriPriority)
+	}
+	if nd.Subject != "3 notifs: held during quiet hours" {
+		t.Errorf("subject %q", nd.Subject)
+	}
+
+	// Grouped by domain and authorization, oldest first within each
+	a := strings.Index(nd.Body, "a.example")
+	b := strings.Index(nd.Body, "b.example (Alarm)")
+	closed := strings.Index(nd.Body, "Door closed")
+	open := strings.Index(nd.Body, "Door open")
+	if a < 0 || b < a || closed < b || open < closed {
+		t.Errorf("body:\n%s", nd.Body)
+	}
+}
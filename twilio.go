@@ -0,0 +1,112 @@
+/*
+
+twilio.go - Text and voice push via Twilio for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+import (
+	"bitbucket.org/ckvist/twilio/twirest"
+	"errors"
+	"github.com/jimfenton/notif-agent/notif"
+	"net/url"
+	"sync"
+)
+
+type textDeliverer struct{}
+type voiceDeliverer struct{}
+
+func init() {
+	registerDeliverer(ModeText, textDeliverer{})
+	registerDeliverer(ModeVoice, voiceDeliverer{})
+}
+
+// Twilio clients, cached by account SID and token
+var twclients = struct {
+	sync.Mutex
+	m map[string]*twirest.TwilioClient
+}{m: make(map[string]*twirest.TwilioClient)}
+
+func twilioClient(sid string, token string) *twirest.TwilioClient {
+	twclients.Lock()
+	defer twclients.Unlock()
+
+	key := sid + " " + token
+	c, ok := twclients.m[key]
+	if !ok {
+		c = twirest.NewClient(sid, token)
+		twclients.m[key] = c
+	}
+	return c
+}
+
+// Twilio account to use: the user's if configured, otherwise the site's
+func twilioAccount(user notif.Userinfo, site notif.Siteinfo) (sid string, token string, from string) {
+	if user.TwilioSID != "" {
+		return user.TwilioSID, user.TwilioToken, user.TwilioFrom
+	}
+	return site.TwilioSID, site.TwilioToken, site.TwilioFrom
+}
+
+func (textDeliverer) Deliver(m Method, n notif.Notif, user notif.Userinfo, site notif.Siteinfo) DeliveryResult {
+	twilioSID, twilioToken, twilioFrom := twilioAccount(user, site)
+
+	if m.Address == "" {
+		return permanentFailure(errors.New("can't send text: method address empty"))
+	}
+	if twilioFrom == "" {
+		return permanentFailure(errors.New("can't send text: user 'from' phone number empty"))
+	}
+	msg := twirest.SendMessage{
+		Text: m.Preamble + ": " + n.Subject,
+		To:   e164norm(m.Address),
+		From: e164norm(twilioFrom)}
+	_, err := twilioClient(twilioSID, twilioToken).Request(msg)
+	if err != nil {
+		return retryableFailure(err)
+	}
+	return deliverySent()
+}
+
+func (voiceDeliverer) Deliver(m Method, n notif.Notif, user notif.Userinfo, site notif.Siteinfo) DeliveryResult {
+	twilioSID, twilioToken, twilioFrom := twilioAccount(user, site)
+
+	if m.Address == "" {
+		return permanentFailure(errors.New("can't send voice message: method address empty"))
+	}
+	if twilioFrom == "" {
+		return permanentFailure(errors.New("can't send voice message: user 'from' phone number empty"))
+	}
+	twimlurl := "http://twimlets.com/message?Message%5B0%5D=" + url.QueryEscape(m.Preamble+" "+n.Subject)
+
+	msg := twirest.MakeCall{
+		From: e164norm(twilioFrom),
+		To:   e164norm(m.Address),
+		Url:  twimlurl}
+	_, err := twilioClient(twilioSID, twilioToken).Request(msg)
+	if err != nil {
+		return retryableFailure(err)
+	}
+	return deliverySent()
+}
@@ -0,0 +1,129 @@
+/*
+
+webhook.go - Webhook push for prototype notification agent
+
+Copyright (c) 2017 Jim Fenton
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to
+deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+sell copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jimfenton/notif-agent/notif"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/* A webhook method POSTs the notif as JSON to Method.Address. The time
+of the request, in seconds since the epoch, is sent as
+"X-Notif-Timestamp: <time>". The timestamp, a period, and the body are
+signed with HMAC-SHA256 using Method.Secret, and the hex digest is sent
+as "X-Notif-Signature: sha256=<digest>". The receiver can then check
+that the request came from the agent, and refuse old requests that are
+being replayed. */
+
+type webhookDeliverer struct {
+	client *http.Client
+}
+
+type webhookPayload struct {
+	NotID    string         `json:"notid"`
+	Subject  string         `json:"subject"`
+	Body     string         `json:"body"`
+	Priority notif.NotifPri `json:"priority"`
+	From     string         `json:"from"` //Originating domain
+	Origtime time.Time      `json:"origtime"`
+	Expires  time.Time      `json:"expires"`
+}
+
+func init() {
+	registerDeliverer(ModeWebhook, webhookDeliverer{client: &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // Redirects count as failures
+		},
+	}})
+}
+
+func (d webhookDeliverer) Deliver(m Method, n notif.Notif, user notif.Userinfo, site notif.Siteinfo) DeliveryResult {
+	if m.Address == "" {
+		return permanentFailure(errors.New("can't call webhook: method address empty"))
+	}
+	if m.Secret == "" {
+		return permanentFailure(errors.New("can't call webhook: method secret empty"))
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		NotID:    n.NotID,
+		Subject:  n.Subject,
+		Body:     n.Body,
+		Priority: n.Priority,
+		From:     n.From,
+		Origtime: n.Origtime,
+		Expires:  n.Expires})
+	if err != nil {
+		return permanentFailure(err)
+	}
+
+	req, err := http.NewRequest("POST", m.Address, bytes.NewReader(body))
+	if err != nil {
+		return permanentFailure(err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Notif-Timestamp", ts)
+	req.Header.Set("X-Notif-Signature", "sha256="+webhookSignature(m.Secret, ts, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return retryableFailure(err)
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return deliverySent()
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return retryableFailure(fmt.Errorf("webhook returned %s", resp.Status))
+	}
+	return permanentFailure(fmt.Errorf("webhook returned %s", resp.Status))
+}
+
+// Hex-encoded HMAC-SHA256 of a webhook timestamp and body
+func webhookSignature(secret string, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
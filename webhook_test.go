@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jimfenton/notif-agent/notif"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliver(t *testing.T) {
+	const secret = "s3cret"
+	origtime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	n := notif.Notif{NotID: testNotID, Subject: "Door open", Body: "The garage door is open.",
+		Priority: notif.PriPriority, From: "example.com", Origtime: origtime, Expires: origtime.Add(time.Hour)}
+
+	tests := []struct {
+		name   string
+		status int
+		want   DeliveryStatus
+	}{
+		{"ok", http.StatusOK, DeliverySent},
+		{"accepted", http.StatusAccepted, DeliverySent},
+		{"redirect", http.StatusFound, DeliveryPermanentFailure},
+		{"bad request", http.StatusBadRequest, DeliveryPermanentFailure},
+		{"gone", http.StatusGone, DeliveryPermanentFailure},
+		{"timeout", http.StatusRequestTimeout, DeliveryRetryableFailure},
+		{"too many requests", http.StatusTooManyRequests, DeliveryRetryableFailure},
+		{"server error", http.StatusInternalServerError, DeliveryRetryableFailure},
+		{"unavailable", http.StatusServiceUnavailable, DeliveryRetryableFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			var body []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				body, _ = ioutil.ReadAll(r.Body)
+				if tt.status == http.StatusFound {
+					http.Redirect(w, r, "/elsewhere", tt.status)
+					return
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			before := time.Now().Unix()
+			res := deliverers[ModeWebhook].Deliver(Method{Address: srv.URL, Secret: secret}, n, notif.Userinfo{}, notif.Siteinfo{})
+			if res.Status != tt.want {
+				t.Errorf("result %v, want %v", res, tt.want)
+			}
+			if got == nil {
+				t.Fatal("webhook not called")
+			}
+			if got.Method != "POST" || got.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("%s with Content-Type %q", got.Method, got.Header.Get("Content-Type"))
+			}
+
+			ts := got.Header.Get("X-Notif-Timestamp")
+			sent, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil || sent < before || sent > time.Now().Unix() {
+				t.Errorf("X-Notif-Timestamp %q, want the time sent", ts)
+			}
+
+			// What a receiver would check
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(ts + "." + string(body)))
+			want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			if sig := got.Header.Get("X-Notif-Signature"); !hmac.Equal([]byte(sig), []byte(want)) {
+				t.Errorf("X-Notif-Signature %q, want %q", sig, want)
+			}
+
+			var p map[string]interface{}
+			if err := json.Unmarshal(body, &p); err != nil {
+				t.Fatalf("body %q: %v", body, err)
+			}
+			fields := map[string]interface{}{"notid": testNotID, "subject": n.Subject, "body": n.Body,
+				"priority": float64(notif.PriPriority), "from": "example.com",
+				"origtime": origtime.Format(time.RFC3339Nano), "expires": n.Expires.Format(time.RFC3339Nano)}
+			for k, v := range fields {
+				if p[k] != v {
+					t.Errorf("%s = %v, want %v", k, p[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookSignatureCoversTimestamp(t *testing.T) {
+	body := []byte(`{"notid":"x"}`)
+	if webhookSignature("k", "1700000000", body) == webhookSignature("k", "1700000001", body) {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+	if webhookSignature("k", "1700000000", body) == webhookSignature("other", "1700000000", body) {
+		t.Error("signature doesn't depend on the secret")
+	}
+}
+
+func TestWebhookUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	res := deliverers[ModeWebhook].Deliver(Method{Address: url, Secret: "k"}, notif.Notif{}, notif.Userinfo{}, notif.Siteinfo{})
+	if res.Status != DeliveryRetryableFailure {
+		t.Errorf("result %v, want retryable failure", res)
+	}
+	res = deliverers[ModeWebhook].Deliver(Method{Address: url}, notif.Notif{}, notif.Userinfo{}, notif.Siteinfo{})
+	if res.Status != DeliveryPermanentFailure {
+		t.Errorf("without secret: result %v, want permanent failure", res)
+	}
+}
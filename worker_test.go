@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunEvery(t *testing.T) {
+	var calls int32
+	w := runEvery(time.Millisecond, func() { atomic.AddInt32(&calls, 1) })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("worker not called repeatedly")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	n := atomic.LoadInt32(&calls)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != n {
+		t.Error("worker called after stop returned")
+	}
+}
+
+func TestWorkerStopTimeout(t *testing.T) {
+	release := make(chan struct{})
+	w := runEvery(time.Hour, func() { <-release })
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("stop of busy worker: %v, want %v", err, context.DeadlineExceeded)
+	}
+}